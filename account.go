@@ -1,78 +1,178 @@
 package main
 
 import (
-	"crypto/sha512"
-	"encoding/hex"
+	"context"
 	"errors"
-	"github.com/gin-gonic/gin"
+	"github.com/WiiLink24/Mail-Server/secrets"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
-	"net/http"
 )
 
-const CreateAccount = `INSERT INTO accounts (mlid, password, mlchkid) VALUES ($1, $2, $3)`
+const (
+	CreateAccount           = `INSERT INTO accounts (mlid, password, mlchkid, serial_hash) VALUES ($1, $2, $3, $4)`
+	DeleteAccountMail       = `DELETE FROM mail WHERE recipient = $1 OR (sender = $1 AND is_sent = false)`
+	DeleteAccountQuarantine = `DELETE FROM quarantine WHERE recipient = $1 OR sender = $1`
+	DeleteAccount           = `DELETE FROM accounts WHERE mlid = $1`
+)
+
+var ErrAccountNotFound = errors.New("account does not exist")
+
+// Credentials are the secrets given to a console for its nwc24msg.cfg, along with the hashes we store.
+type Credentials struct {
+	Password     string
+	PasswordHash string
+	Mlchkid      string
+	MlchkidHash  string
+}
+
+func generateCredentials() Credentials {
+	// Password can be any length up to 32 characters. 16 seems like a good middle ground.
+	password := secrets.String(16)
+
+	// Mlchkid must be a string of 32 characters
+	mlchkid := secrets.String(32)
+
+	return Credentials{
+		Password:     password,
+		PasswordHash: hashPasswd(password),
+		Mlchkid:      mlchkid,
+		MlchkidHash:  hashMlchkid(mlchkid),
+	}
+}
+
+// deleteAccount removes an account along with all mail addressed to it, any quarantined mail,
+// and mail it sent that has not yet been received. mlid is expected without the w.
+func deleteAccount(ctx context.Context, mlid string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, DeleteAccountMail, mlid)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, DeleteAccountQuarantine, mlid)
+	if err != nil {
+		return err
+	}
+
+	tag, err := tx.Exec(ctx, DeleteAccount, mlid)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrAccountNotFound
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
 
-func account(c *gin.Context) {
-	mlid := c.PostForm("mlid")
+	checkCache.ForgetAccount(mlid)
+	return nil
+}
+
+func account(r *Response) {
+	mlid := r.PostForm("mlid")
 	if mlid == "" {
-		cgi := GenCGIError(610, "mlid not found")
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeInvalidMlid, "mlid not found")
+		r.WriteCGI(cgi)
 		return
 	}
 
 	if !validateFriendCode(mlid[1:]) {
-		cgi := GenCGIError(610, "Invalid Wii Friend Code")
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeInvalidMlid, "Invalid Wii Friend Code")
+		r.WriteCGI(cgi)
 		return
 	}
 
-	c.Header("Content-Type", "text/plain;charset=utf-8")
-
-	// Password can be any length up to 32 characters. 16 seems like a good middle ground.
-	password := RandStringBytesMaskImprSrc(16)
-	passwordByte := sha512.Sum512([]byte(password))
-	passwordHash := hex.EncodeToString(passwordByte[:])
-
-	// Mlchkid must be a string of 32 characters
-	mlchkid := RandStringBytesMaskImprSrc(32)
-	mlchkidByte := sha512.Sum512([]byte(mlchkid))
-	mlchkidHash := hex.EncodeToString(mlchkidByte[:])
+	err := checkBans(r.Context(), mlid[1:], r.ClientIP())
+	if cgi, banned := banResponse(err); banned {
+		r.WriteCGI(cgi)
+		return
+	} else if err != nil {
+		cgi := GenCGIError(CGICodeRegistrationFailed, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
+		return
+	}
 
-	_, err := pool.Exec(c.Copy(), CreateAccount, mlid[1:], passwordHash, mlchkidHash)
+	serial := r.PostForm(SerialNumberKey)
+	credentials := generateCredentials()
+	_, err = pool.Exec(r.Context(), CreateAccount, mlid[1:], credentials.PasswordHash, credentials.MlchkidHash, optionalSerialHash(mlid[1:], serial))
 	if err != nil {
 		var v *pgconn.PgError
 		if errors.As(err, &v) {
 			if pgerrcode.IsIntegrityConstraintViolation(v.Code) {
-				cgi := GenCGIError(211, "Duplicate registration.")
-				c.String(http.StatusOK, ConvertToCGI(cgi))
+				reprovision(r, mlid, serial)
 				return
 			}
 		}
 
-		cgi := GenCGIError(410, "An error has occurred while querying the database.")
-		ReportErrorGin(c, err)
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeRegistrationFailed, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
+		return
+	}
+
+	r.WriteCGI(credentialsResponse(mlid, credentials))
+}
+
+// reprovision handles a registration for an mlid that already exists. Consoles that lose their
+// nwc24msg.cfg can only get new credentials by proving they own the mlid, see verifyReprovision.
+func reprovision(r *Response, mlid, serial string) {
+	ctx := r.Context()
+	ip := r.ClientIP()
+
+	// Proving ownership is as good as knowing the passwd, so failures count towards the same limits.
+	delay, err := authLimiter.Check(mlid, ip)
+	if err != nil {
+		recordAuthFailure(ctx, mlid, ip, "locked")
+		cgi := GenCGIError(CGICodeDuplicateRegistration, "Duplicate registration.")
+		r.WriteCGI(cgi)
+		return
+	}
+
+	err = sleepContext(ctx, delay)
+	if err != nil {
+		return
+	}
+
+	err = verifyReprovision(ctx, mlid[1:], r.PostForm(ReprovisionTokenKey), r.PostForm(HollywoodIDKey), serial)
+	if errors.Is(err, ErrReprovisionDenied) {
+		authLimiter.Fail(mlid, ip)
+		recordAuthFailure(ctx, mlid, ip, "reprovision_denied")
+		cgi := GenCGIError(CGICodeDuplicateRegistration, "Duplicate registration.")
+		r.WriteCGI(cgi)
+		return
+	} else if err != nil {
+		cgi := GenCGIError(CGICodeRegistrationFailed, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
 		return
 	}
 
-	cgi := CGIResponse{
-		code:    100,
-		message: "Success.",
-		other: []KV{
-			{
-				key:   "mlid",
-				value: mlid,
-			},
-			{
-				key:   "passwd",
-				value: password,
-			},
-			{
-				key:   "mlchkid",
-				value: mlchkid,
-			},
-		},
+	authLimiter.Succeed(mlid, ip)
+	credentials, err := rotateCredentials(ctx, mlid[1:], serial)
+	if err != nil {
+		cgi := GenCGIError(CGICodeRegistrationFailed, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
+		return
 	}
 
-	c.String(http.StatusOK, ConvertToCGI(cgi))
+	r.WriteCGI(credentialsResponse(mlid, credentials))
+}
+
+func credentialsResponse(mlid string, credentials Credentials) CGIResponse {
+	cgi := GenCGISuccess()
+	cgi.Add("mlid", mlid)
+	cgi.Add("passwd", credentials.Password)
+	cgi.Add("mlchkid", credentials.Mlchkid)
+	return cgi
 }
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	QueryAccount = `SELECT accounts.mlid, contact_policy,
+			COUNT(m.snowflake) FILTER (WHERE m.is_sent = false),
+			COALESCE(SUM(LENGTH(COALESCE(m.data, b.data))) FILTER (WHERE m.is_sent = false), 0),
+			COUNT(m.snowflake) FILTER (WHERE m.is_sent = true),
+			COALESCE(SUM(LENGTH(COALESCE(m.data, b.data))) FILTER (WHERE m.is_sent = true), 0)
+		FROM accounts LEFT JOIN mail m ON m.recipient = accounts.mlid LEFT JOIN broadcasts b ON b.id = m.broadcast_id
+		WHERE accounts.mlid = $1 GROUP BY accounts.mlid, contact_policy`
+	QueryAccountMail = `SELECT m.snowflake, m.sender, m.is_sent, LENGTH(COALESCE(m.data, b.data)), COALESCE(m.app_id, '') FROM mail m
+		LEFT JOIN broadcasts b ON b.id = m.broadcast_id WHERE m.recipient = $1 AND ($2 = '' OR m.is_sent = ($2 = 'sent')) ORDER BY m.snowflake`
+	QueryMail = `SELECT m.snowflake, m.sender, m.recipient, m.is_sent, COALESCE(m.data, b.data) FROM mail m
+		LEFT JOIN broadcasts b ON b.id = m.broadcast_id WHERE m.snowflake = $1`
+	DeleteMail       = `DELETE FROM mail WHERE snowflake = $1 RETURNING recipient`
+	ResetCredentials = `UPDATE accounts SET password = $2, mlchkid = $3 WHERE mlid = $1`
+	CountQueuedMail  = `SELECT COUNT(*) FROM mail WHERE is_sent = false`
+)
+
+const AdminTokenPrefix = "Bearer "
+
+type AdminAccount struct {
+	Mlid          string `json:"mlid"`
+	ContactPolicy string `json:"contact_policy"`
+	QueuedMail    int64  `json:"queued_mail"`
+	QueuedBytes   int64  `json:"queued_bytes"`
+	SentMail      int64  `json:"sent_mail"`
+	SentBytes     int64  `json:"sent_bytes"`
+}
+
+type AdminMail struct {
+	Snowflake string `json:"snowflake"`
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient,omitempty"`
+	IsSent    bool   `json:"is_sent"`
+	Size      int64  `json:"size"`
+	Data      string `json:"data,omitempty"`
+	AppID     string `json:"app_id,omitempty"`
+}
+
+// adminAuth rejects requests without one of the configured tokens.
+func adminAuth(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, AdminTokenPrefix) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+		return
+	}
+
+	token := []byte(strings.TrimPrefix(header, AdminTokenPrefix))
+	for _, allowed := range config.AdminTokens {
+		if allowed != "" && subtle.ConstantTimeCompare(token, []byte(allowed)) == 1 {
+			c.Next()
+			return
+		}
+	}
+
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+}
+
+// adminError reports err and writes it as the response.
+func adminError(c *gin.Context, err error) {
+	ReportErrorGin(c, err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+}
+
+// adminMlid reads the mlid route parameter, with or without its w.
+func adminMlid(c *gin.Context) (string, bool) {
+	mlid := strings.TrimPrefix(c.Param("mlid"), "w")
+	if !validateFriendCode(mlid) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mlid"})
+		return "", false
+	}
+
+	return mlid, true
+}
+
+func adminSnowflake(c *gin.Context) (int64, bool) {
+	snowflake, err := strconv.ParseInt(c.Param("snowflake"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid snowflake"})
+		return 0, false
+	}
+
+	return snowflake, true
+}
+
+func adminGetAccount(c *gin.Context) {
+	mlid, ok := adminMlid(c)
+	if !ok {
+		return
+	}
+
+	var account AdminAccount
+	err := pool.QueryRow(c, QueryAccount, mlid).Scan(&account.Mlid, &account.ContactPolicy, &account.QueuedMail, &account.QueuedBytes, &account.SentMail, &account.SentBytes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+func adminListMail(c *gin.Context) {
+	mlid, ok := adminMlid(c)
+	if !ok {
+		return
+	}
+
+	status := c.Query("status")
+	if status != "" && status != "queued" && status != "sent" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be queued, sent or empty"})
+		return
+	}
+
+	rows, err := pool.Query(c, QueryAccountMail, mlid, status)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	mail, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AdminMail, error) {
+		var m AdminMail
+		var snowflake int64
+		err := row.Scan(&snowflake, &m.Sender, &m.IsSent, &m.Size, &m.AppID)
+		m.Snowflake = strconv.FormatInt(snowflake, 10)
+		return m, err
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"mail": mail})
+}
+
+func adminGetMail(c *gin.Context) {
+	snowflake, ok := adminSnowflake(c)
+	if !ok {
+		return
+	}
+
+	var m AdminMail
+	err := pool.QueryRow(c, QueryMail, snowflake).Scan(nil, &m.Sender, &m.Recipient, &m.IsSent, &m.Data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "mail not found"})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	m.Snowflake = strconv.FormatInt(snowflake, 10)
+	m.Size = int64(len(m.Data))
+	c.JSON(http.StatusOK, m)
+}
+
+func adminDeleteMail(c *gin.Context) {
+	snowflake, ok := adminSnowflake(c)
+	if !ok {
+		return
+	}
+
+	var recipient string
+	err := pool.QueryRow(c, DeleteMail, snowflake).Scan(&recipient)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "mail not found"})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	checkCache.ForgetMailbox(recipient)
+
+	c.Status(http.StatusNoContent)
+}
+
+// adminResetCredentials issues a new passwd and mlchkid for an account.
+// The console has to be given these in its nwc24msg.cfg before it can connect again.
+func adminResetCredentials(c *gin.Context) {
+	mlid, ok := adminMlid(c)
+	if !ok {
+		return
+	}
+
+	credentials, err := rotateCredentials(c, mlid, "")
+	if errors.Is(err, ErrAccountNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	log.Printf("Credentials for w%s were reset through the admin API", mlid)
+	c.JSON(http.StatusOK, gin.H{
+		"mlid":    "w" + mlid,
+		"passwd":  credentials.Password,
+		"mlchkid": credentials.Mlchkid,
+	})
+}
+
+// adminIssueToken issues a one-time token the owner of an account can re-register their console with.
+func adminIssueToken(c *gin.Context) {
+	mlid, ok := adminMlid(c)
+	if !ok {
+		return
+	}
+
+	ttl := DefaultReprovisionTokenTTL
+	if c.Query("ttl") != "" {
+		var err error
+		ttl, err = time.ParseDuration(c.Query("ttl"))
+		if err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid ttl"})
+			return
+		}
+	}
+
+	token, err := issueReprovisionToken(c, mlid, "admin-api", ttl)
+	if errors.Is(err, ErrAccountNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"mlid":       "w" + mlid,
+		"token":      token,
+		"expires_at": time.Now().Add(ttl),
+	})
+}
+
+// adminSetAccountInterval sets how often an account checks for mail, in minutes. 0 returns it to the default.
+func adminSetAccountInterval(c *gin.Context) {
+	mlid, ok := adminMlid(c)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Interval int `json:"interval"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Interval < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be a number of minutes"})
+		return
+	}
+
+	var interval *int
+	if body.Interval > 0 {
+		clamped := clampInterval(body.Interval)
+		interval = &clamped
+	}
+
+	tag, err := pool.Exec(c, UpdateCheckInterval, mlid, interval)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	if tag.RowsAffected() == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "account not found"})
+		return
+	}
+
+	checkCache.ForgetAccount(mlid)
+
+	c.JSON(http.StatusOK, gin.H{"mlid": "w" + mlid, "interval": interval})
+}
+
+func adminGetIntervals(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"default":    defaultCheckInterval(),
+		"override":   globalCheckInterval.Load(),
+		"check_rate": checkLoad.Rate(time.Now()),
+	})
+}
+
+// adminSetIntervals overrides the configured default interval until the server restarts. 0 removes the override.
+func adminSetIntervals(c *gin.Context) {
+	var body struct {
+		Default int `json:"default"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Default < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "default must be a number of minutes"})
+		return
+	}
+
+	globalCheckInterval.Store(int64(body.Default))
+	log.Printf("Default check interval set to %d minutes through the admin API", defaultCheckInterval())
+	adminGetIntervals(c)
+}
+
+// adminQueues reports how much mail is waiting to be picked up by consoles,
+// and how much inbound mail is waiting in S3 to be processed.
+func adminQueues(c *gin.Context) {
+	var outbound int64
+	err := pool.QueryRow(c, CountQueuedMail).Scan(&outbound)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	objects, err := GetObjects()
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"outbound": outbound,
+		"inbound":  len(objects),
+	})
+}
+
+// startAdminServer serves the admin API on its own address, which must not be the one consoles connect to.
+func startAdminServer() {
+	if config.AdminAddress == "" {
+		return
+	}
+
+	if config.AdminAddress == config.Address {
+		log.Fatalln("AdminAddress must not be the same as Address, otherwise the admin API is reachable by consoles.")
+	}
+
+	if len(config.AdminTokens) == 0 {
+		log.Fatalln("AdminAddress is set without any AdminTokens.")
+	}
+
+	g := newAdminRouter()
+
+	log.Printf("Starting admin API (%s)...", config.AdminAddress)
+	go func() {
+		log.Fatalln(g.Run(config.AdminAddress))
+	}()
+}
+
+// newAdminRouter returns the admin API's routes, which require one of the configured tokens.
+func newAdminRouter() *gin.Engine {
+	g := gin.New()
+	g.Use(gin.Recovery(), adminAuth)
+
+	admin := g.Group("/admin")
+	admin.GET("/accounts/:mlid", adminGetAccount)
+	admin.GET("/accounts/:mlid/mail", adminListMail)
+	admin.POST("/accounts/:mlid/reset", adminResetCredentials)
+	admin.POST("/accounts/:mlid/token", adminIssueToken)
+	admin.PUT("/accounts/:mlid/interval", adminSetAccountInterval)
+	admin.GET("/accounts/:mlid/quarantine", adminListQuarantine)
+	admin.GET("/intervals", adminGetIntervals)
+	admin.PUT("/intervals", adminSetIntervals)
+	admin.GET("/mail/:snowflake", adminGetMail)
+	admin.DELETE("/mail/:snowflake", adminDeleteMail)
+	admin.POST("/quarantine/:snowflake/release", adminReleaseQuarantine)
+	admin.GET("/queues", adminQueues)
+	admin.GET("/titles", adminTitleStats)
+	admin.POST("/communities", adminCreateCommunity)
+	admin.GET("/broadcasts", adminListBroadcasts)
+	admin.POST("/broadcasts", adminCreateBroadcast)
+	admin.GET("/broadcasts/:id", adminGetBroadcast)
+	admin.POST("/broadcasts/:id/pause", adminPauseBroadcast)
+	admin.POST("/broadcasts/:id/resume", adminResumeBroadcast)
+	admin.GET("/events", adminEvents)
+
+	return g
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminAuth(_t *testing.T) {
+	config = &Config{AdminTokens: []string{"first-token", "second-token"}}
+	defer func() { config = nil }()
+
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	g.Use(adminAuth)
+	g.GET("/admin/queues", func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	cases := map[string]int{
+		"":                    http.StatusUnauthorized,
+		"first-token":         http.StatusUnauthorized,
+		"Bearer wrong-token":  http.StatusUnauthorized,
+		"Bearer first-token":  http.StatusOK,
+		"Bearer second-token": http.StatusOK,
+	}
+
+	for header, expected := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/admin/queues", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+		if w.Code != expected {
+			_t.Errorf("Authorization '%s': expected %d, got %d", header, expected, w.Code)
+		}
+	}
+}
+
+// adminRequest makes a request to the admin API with a valid token, setting config.AdminTokens to allow it.
+func adminRequest(g *gin.Engine, method, path string, body io.Reader) *httptest.ResponseRecorder {
+	config.AdminTokens = []string{"test-token"}
+	req := httptest.NewRequest(method, path, body)
+	req.Header.Set("Authorization", AdminTokenPrefix+"test-token")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	return w
+}
+
+// TestAdminHandlers checks each admin API endpoint for an account and its mail, including requests that are not found
+// or malformed.
+func TestAdminHandlers(_t *testing.T) {
+	config = &Config{}
+	previousCache, previousLimiter := checkCache, authLimiter
+	defer func() {
+		config = nil
+		checkCache, authLimiter = previousCache, previousLimiter
+	}()
+	testDatabase(_t)
+	checkCache, authLimiter = NewCheckCache(), NewAuthLimiter()
+
+	sender, recipient, missing := "1000000000000016", "1000000000000017", "1000000000000778"
+	createTestAccounts(_t, sender, recipient)
+	err := deleteAccount(context.Background(), missing)
+	if err != nil && !errors.Is(err, ErrAccountNotFound) {
+		_t.Fatal(err)
+	}
+
+	data := readEnvelopeFixture(_t, "wii_to_wii.txt")
+	snowflake := flakeNode.Generate().Int64()
+	_, err = pool.Exec(context.Background(), InsertMail, snowflake, data, sender, recipient, nil, nil)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	g := newAdminRouter()
+	mail := "/admin/mail/" + strconv.FormatInt(snowflake, 10)
+	cases := []struct {
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		{http.MethodGet, "/admin/accounts/w" + recipient, "", http.StatusOK},
+		{http.MethodGet, "/admin/accounts/w" + missing, "", http.StatusNotFound},
+		{http.MethodGet, "/admin/accounts/w1234", "", http.StatusBadRequest},
+		{http.MethodGet, "/admin/accounts/w" + recipient + "/mail?status=queued", "", http.StatusOK},
+		{http.MethodGet, "/admin/accounts/w" + recipient + "/mail?status=unknown", "", http.StatusBadRequest},
+		{http.MethodPost, "/admin/accounts/w" + missing + "/reset", "", http.StatusNotFound},
+		{http.MethodPost, "/admin/accounts/w" + recipient + "/token?ttl=soon", "", http.StatusBadRequest},
+		{http.MethodPost, "/admin/accounts/w" + missing + "/token", "", http.StatusNotFound},
+		{http.MethodPut, "/admin/accounts/w" + recipient + "/interval", `{"interval":-1}`, http.StatusBadRequest},
+		{http.MethodPut, "/admin/accounts/w" + missing + "/interval", `{"interval":5}`, http.StatusNotFound},
+		{http.MethodPut, "/admin/intervals", `{"default":"ten"}`, http.StatusBadRequest},
+		{http.MethodGet, mail, "", http.StatusOK},
+		{http.MethodGet, "/admin/mail/1", "", http.StatusNotFound},
+		{http.MethodGet, "/admin/mail/abc", "", http.StatusBadRequest},
+		{http.MethodDelete, "/admin/mail/abc", "", http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		var body io.Reader
+		if tc.body != "" {
+			body = strings.NewReader(tc.body)
+		}
+
+		if w := adminRequest(g, tc.method, tc.path, body); w.Code != tc.expected {
+			_t.Errorf("%s %s: expected %d, got %d: %s", tc.method, tc.path, tc.expected, w.Code, w.Body.String())
+		}
+	}
+
+	var account AdminAccount
+	adminJSON(_t, g, http.MethodGet, "/admin/accounts/w"+recipient, nil, &account)
+	if account.Mlid != recipient || account.QueuedMail != 1 || account.QueuedBytes != int64(len(data)) || account.SentMail != 0 {
+		_t.Errorf("Incorrect account %+v", account)
+	}
+
+	var list struct {
+		Mail []AdminMail `json:"mail"`
+	}
+	adminJSON(_t, g, http.MethodGet, "/admin/accounts/w"+recipient+"/mail?status=sent", nil, &list)
+	if len(list.Mail) != 0 {
+		_t.Errorf("Expected no sent mail, got %+v", list.Mail)
+	}
+
+	adminJSON(_t, g, http.MethodGet, "/admin/accounts/w"+recipient+"/mail", nil, &list)
+	if len(list.Mail) != 1 || list.Mail[0].Snowflake != strconv.FormatInt(snowflake, 10) || list.Mail[0].Sender != sender {
+		_t.Errorf("Incorrect mail %+v", list.Mail)
+	}
+
+	// The snowflake is skipped when scanning, and taken from the path instead.
+	var m AdminMail
+	adminJSON(_t, g, http.MethodGet, mail, nil, &m)
+	if m.Snowflake != strconv.FormatInt(snowflake, 10) || m.Recipient != recipient || m.Data != data || m.Size != int64(len(data)) {
+		_t.Errorf("Incorrect mail %+v", m)
+	}
+
+	// Deleting mail has to clear the recipient's cached mailbox, or check.cgi would still report it.
+	checkCache.Put("hash", CheckState{Mlid: recipient, OldestMail: snowflake, NewestMail: snowflake}, checkCache.Now())
+	if w := adminRequest(g, http.MethodDelete, mail, nil); w.Code != http.StatusNoContent {
+		_t.Fatalf("Deleting failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	if _, ok := checkCache.Get("hash"); ok {
+		_t.Errorf("Expected the mailbox to be forgotten")
+	}
+
+	if w := adminRequest(g, http.MethodDelete, mail, nil); w.Code != http.StatusNotFound {
+		_t.Errorf("Expected deleting twice to be not found, got %d", w.Code)
+	}
+
+	// Resetting credentials gives out a passwd that works, and forgets the old mlchkid.
+	checkCache.Put("hash", CheckState{Mlid: recipient}, checkCache.Now())
+	var credentials struct {
+		Mlid    string `json:"mlid"`
+		Passwd  string `json:"passwd"`
+		Mlchkid string `json:"mlchkid"`
+	}
+	adminJSON(_t, g, http.MethodPost, "/admin/accounts/"+recipient+"/reset", nil, &credentials)
+	if credentials.Mlid != "w"+recipient || len(credentials.Mlchkid) != 32 {
+		_t.Errorf("Incorrect credentials %+v", credentials)
+	}
+
+	if err := validatePassword(context.Background(), "w"+recipient, credentials.Passwd, "192.0.2.1"); err != nil {
+		_t.Errorf("Expected the new passwd to be valid, got %v", err)
+	}
+
+	if _, ok := checkCache.Get("hash"); ok {
+		_t.Errorf("Expected the account to be forgotten")
+	}
+
+	var token struct {
+		Token string `json:"token"`
+	}
+	adminJSON(_t, g, http.MethodPost, "/admin/accounts/w"+recipient+"/token?ttl=1h", nil, &token)
+	if err := verifyReprovision(context.Background(), recipient, token.Token, "", ""); err != nil {
+		_t.Errorf("Expected the token to be redeemable, got %v", err)
+	}
+
+	var interval struct {
+		Interval *int `json:"interval"`
+	}
+	adminJSON(_t, g, http.MethodPut, "/admin/accounts/w"+recipient+"/interval", strings.NewReader(`{"interval":5}`), &interval)
+	if interval.Interval == nil || *interval.Interval != 5 {
+		_t.Errorf("Incorrect interval %v", interval.Interval)
+	}
+
+	adminJSON(_t, g, http.MethodPut, "/admin/accounts/w"+recipient+"/interval", strings.NewReader(`{"interval":0}`), &interval)
+	if interval.Interval != nil {
+		_t.Errorf("Expected the interval to be removed, got %d", *interval.Interval)
+	}
+
+	defer globalCheckInterval.Store(0)
+	var intervals struct {
+		Default  int `json:"default"`
+		Override int `json:"override"`
+	}
+	adminJSON(_t, g, http.MethodPut, "/admin/intervals", strings.NewReader(`{"default":7}`), &intervals)
+	if intervals.Default != 7 || intervals.Override != 7 {
+		_t.Errorf("Incorrect intervals %+v", intervals)
+	}
+}
+
+// TestAdminQueues checks queued mail is counted from the database and inbound mail from the bucket.
+func TestAdminQueues(_t *testing.T) {
+	config = &Config{AWSBucket: "inbound"}
+	previousClient := s3Client
+	defer func() {
+		config = nil
+		s3Client = previousClient
+	}()
+	testDatabase(_t)
+
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		_, _ = io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>inbound</Name><IsTruncated>false</IsTruncated>`+
+			`<Contents><Key>first</Key></Contents><Contents><Key>second</Key></Contents></ListBucketResult>`)
+	}))
+	defer bucket.Close()
+
+	s3Client = s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(bucket.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+
+	var expected int64
+	err := pool.QueryRow(context.Background(), CountQueuedMail).Scan(&expected)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	var queues struct {
+		Outbound int64 `json:"outbound"`
+		Inbound  int   `json:"inbound"`
+	}
+	adminJSON(_t, newAdminRouter(), http.MethodGet, "/admin/queues", nil, &queues)
+	if queues.Outbound != expected || queues.Inbound != 2 {
+		_t.Errorf("Incorrect queues %+v, expected %d outbound", queues, expected)
+	}
+}
+
+// adminJSON makes a request to the admin API that is expected to succeed, and decodes its response into v.
+func adminJSON(_t *testing.T, g *gin.Engine, method, path string, body io.Reader, v any) {
+	_t.Helper()
+
+	w := adminRequest(g, method, path, body)
+	if w.Code != http.StatusOK {
+		_t.Fatalf("%s %s: expected 200, got %d: %s", method, path, w.Code, w.Body.String())
+	}
+
+	err := json.Unmarshal(w.Body.Bytes(), v)
+	if err != nil {
+		_t.Fatal(err)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// AnimatedImageMode determines how an animated attachment is flattened into the single JPEG the Wii can display.
+type AnimatedImageMode string
+
+const (
+	// AnimatedFirstFrame keeps the behaviour of image.Decode, which only reads the first frame.
+	AnimatedFirstFrame AnimatedImageMode = "first"
+	// AnimatedRepresentativeFrame picks the frame shown halfway through the animation.
+	AnimatedRepresentativeFrame AnimatedImageMode = "representative"
+	// AnimatedContactSheet tiles several frames of the animation into one image.
+	AnimatedContactSheet AnimatedImageMode = "contactsheet"
+)
+
+const (
+	// ContactSheetMaxFrames is the most frames that will be placed on a contact sheet.
+	ContactSheetMaxFrames = 9
+	// ContactSheetTileWidth is the width each frame is scaled to on a contact sheet.
+	ContactSheetTileWidth = 200
+	// MaxAnimationFrames is the most frames that will be decoded from an animation.
+	MaxAnimationFrames = 256
+	// MaxAnimationPixels limits the frames times the canvas area of an animation, as every frame is kept in memory.
+	MaxAnimationPixels = 64 << 20
+)
+
+var (
+	ErrNotAnimated = errors.New("image is not animated")
+	ErrInvalidWebP = errors.New("invalid animated webp")
+	ErrInvalidGIF  = errors.New("invalid gif")
+	// ErrAnimationTooLarge is returned for animations that would take too much memory to decode.
+	ErrAnimationTooLarge = errors.New("animation has too many frames or is too large")
+	webpAnimatedBit      = byte(1 << 1)
+	webpAlphaBit         = byte(1 << 4)
+)
+
+// AnimationFrame is a single fully composited frame of an animation.
+type AnimationFrame struct {
+	Image image.Image
+	// Duration is how long the frame is shown for, in milliseconds.
+	Duration int
+}
+
+// animatedImageMode returns the configured mode, falling back to the first frame.
+func animatedImageMode() AnimatedImageMode {
+	switch mode := AnimatedImageMode(config.AnimatedImageMode); mode {
+	case AnimatedRepresentativeFrame, AnimatedContactSheet:
+		return mode
+	default:
+		return AnimatedFirstFrame
+	}
+}
+
+// decodeAnimation returns every frame of an animated GIF or WebP.
+// ErrNotAnimated is returned for anything else, including GIFs and WebPs with a single frame.
+func decodeAnimation(data []byte) ([]AnimationFrame, error) {
+	var frames []AnimationFrame
+	var err error
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		frames, err = decodeGIFFrames(data)
+	case len(data) >= 12 && bytes.Equal(data[:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		frames, err = decodeWebPFrames(data)
+	default:
+		return nil, ErrNotAnimated
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(frames) < 2 {
+		return nil, ErrNotAnimated
+	}
+
+	return frames, nil
+}
+
+func decodeGIFFrames(data []byte) ([]AnimationFrame, error) {
+	// gif.DecodeAll has no limits of its own, so the size is checked before anything is decoded.
+	cfg, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := countGIFFrames(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if count > MaxAnimationFrames || !animationFits(count, cfg.Width, cfg.Height) {
+		return nil, ErrAnimationTooLarge
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(g.Image) < 2 {
+		return nil, ErrNotAnimated
+	}
+
+	canvasRect := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if canvasRect.Empty() {
+		canvasRect = g.Image[0].Bounds()
+		if !animationFits(len(g.Image), canvasRect.Dx(), canvasRect.Dy()) {
+			return nil, ErrAnimationTooLarge
+		}
+	}
+
+	canvas := image.NewRGBA(canvasRect)
+	frames := make([]AnimationFrame, 0, len(g.Image))
+	for i, paletted := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, paletted.Bounds(), paletted, paletted.Bounds().Min, draw.Over)
+
+		delay := 0
+		if i < len(g.Delay) {
+			// GIF delays are in hundredths of a second.
+			delay = g.Delay[i] * 10
+		}
+
+		frames = append(frames, AnimationFrame{
+			Image:    cloneRGBA(canvas),
+			Duration: delay,
+		})
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, paletted.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return frames, nil
+}
+
+// animationFits reports whether frames of the given size can all be kept in memory.
+func animationFits(frames, width, height int) bool {
+	return frames*width*height <= MaxAnimationPixels
+}
+
+// countGIFFrames counts the image descriptors in a GIF by skipping over the blocks, without decompressing any of them.
+func countGIFFrames(data []byte) (int, error) {
+	// The header is followed by the logical screen descriptor, which may be followed by a global colour table.
+	const headerLength = 13
+	if len(data) < headerLength {
+		return 0, ErrInvalidGIF
+	}
+
+	pos := headerLength
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21:
+			// Extensions are a label followed by sub-blocks.
+			pos += 2
+		case 0x2c:
+			// Image descriptors are followed by an optional local colour table, the LZW code size and sub-blocks.
+			if pos+10 > len(data) {
+				return 0, ErrInvalidGIF
+			}
+
+			frames++
+			if frames > MaxAnimationFrames {
+				return frames, nil
+			}
+
+			flags := data[pos+9]
+			pos += 10
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos++
+		case 0x3b:
+			return frames, nil
+		default:
+			return 0, ErrInvalidGIF
+		}
+
+		// Skip the sub-blocks, which end with an empty block.
+		for {
+			if pos >= len(data) {
+				return 0, ErrInvalidGIF
+			}
+
+			size := int(data[pos])
+			pos += size + 1
+			if size == 0 {
+				break
+			}
+		}
+	}
+
+	// Like image/gif, a missing trailer is accepted.
+	return frames, nil
+}
+
+// decodeWebPFrames walks the RIFF chunks of an animated WebP.
+// x/image/webp cannot read ANMF chunks, so each frame's bitstream is rewrapped into a still WebP container and
+// decoded on its own before being composited onto the canvas.
+func decodeWebPFrames(data []byte) ([]AnimationFrame, error) {
+	if len(data) < 12 {
+		return nil, ErrInvalidWebP
+	}
+
+	var canvas *image.RGBA
+	var frames []AnimationFrame
+	animated := false
+	err := walkRIFFChunks(data[12:], func(fourCC string, payload []byte) error {
+		switch fourCC {
+		case "VP8X":
+			if len(payload) < 10 {
+				return ErrInvalidWebP
+			}
+
+			animated = payload[0]&webpAnimatedBit != 0
+			width := int(readUint24(payload[4:])) + 1
+			height := int(readUint24(payload[7:])) + 1
+			if width*height > MaxImageDimension*MaxImageDimension {
+				return ErrInvalidWebP
+			}
+
+			canvas = image.NewRGBA(image.Rect(0, 0, width, height))
+		case "ANMF":
+			if !animated || canvas == nil || len(payload) < 16 {
+				return ErrInvalidWebP
+			}
+
+			// Every frame is a copy of the canvas, so stop before they take too much memory.
+			if len(frames) >= MaxAnimationFrames || !animationFits(len(frames)+1, canvas.Bounds().Dx(), canvas.Bounds().Dy()) {
+				return ErrAnimationTooLarge
+			}
+
+			x := int(readUint24(payload[0:])) * 2
+			y := int(readUint24(payload[3:])) * 2
+			width := int(readUint24(payload[6:])) + 1
+			height := int(readUint24(payload[9:])) + 1
+			duration := int(readUint24(payload[12:]))
+			doNotBlend := payload[15]&0x02 != 0
+			disposeToBackground := payload[15]&0x01 != 0
+
+			frame, err := decodeWebPFrame(payload[16:], width, height)
+			if err != nil {
+				return err
+			}
+
+			rect := image.Rect(x, y, x+width, y+height)
+			op := draw.Over
+			if doNotBlend {
+				op = draw.Src
+			}
+
+			draw.Draw(canvas, rect, frame, frame.Bounds().Min, op)
+			frames = append(frames, AnimationFrame{
+				Image:    cloneRGBA(canvas),
+				Duration: duration,
+			})
+
+			if disposeToBackground {
+				draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !animated {
+		return nil, ErrNotAnimated
+	}
+
+	return frames, nil
+}
+
+// decodeWebPFrame decodes the ALPH/VP8/VP8L chunks found inside an ANMF chunk.
+func decodeWebPFrame(frameData []byte, width, height int) (image.Image, error) {
+	var body bytes.Buffer
+	hasAlpha := false
+	err := walkRIFFChunks(frameData, func(fourCC string, payload []byte) error {
+		if fourCC == "ALPH" {
+			hasAlpha = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if hasAlpha {
+		// The alpha chunk is only accepted by the decoder after a VP8X header.
+		vp8x := make([]byte, 10)
+		vp8x[0] = webpAlphaBit
+		putUint24(vp8x[4:], uint32(width-1))
+		putUint24(vp8x[7:], uint32(height-1))
+		writeRIFFChunk(&body, "VP8X", vp8x)
+	}
+
+	body.Write(frameData)
+
+	var container bytes.Buffer
+	container.WriteString("RIFF")
+	_ = binary.Write(&container, binary.LittleEndian, uint32(body.Len()+4))
+	container.WriteString("WEBP")
+	container.Write(body.Bytes())
+
+	return webp.Decode(&container)
+}
+
+// walkRIFFChunks calls fn for every chunk in data, which must start at a chunk header.
+func walkRIFFChunks(data []byte, fn func(fourCC string, payload []byte) error) error {
+	for len(data) >= 8 {
+		fourCC := string(data[:4])
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if size < 0 || size > len(data)-8 {
+			return ErrInvalidWebP
+		}
+
+		if err := fn(fourCC, data[8:8+size]); err != nil {
+			return err
+		}
+
+		// Chunks are padded to an even length.
+		next := 8 + size + size&1
+		if next > len(data) {
+			break
+		}
+		data = data[next:]
+	}
+
+	return nil
+}
+
+func writeRIFFChunk(buf *bytes.Buffer, fourCC string, payload []byte) {
+	buf.WriteString(fourCC)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(payload)))
+	buf.Write(payload)
+	if len(payload)&1 == 1 {
+		buf.WriteByte(0)
+	}
+}
+
+func readUint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+func cloneRGBA(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+	return dst
+}
+
+// representativeFrame returns the frame on screen halfway through the animation.
+// Animations without timing information fall back to the middle frame.
+func representativeFrame(frames []AnimationFrame) image.Image {
+	total := 0
+	for _, frame := range frames {
+		total += frame.Duration
+	}
+
+	if total == 0 {
+		return frames[len(frames)/2].Image
+	}
+
+	elapsed := 0
+	for _, frame := range frames {
+		elapsed += frame.Duration
+		if elapsed >= total/2 {
+			return frame.Image
+		}
+	}
+
+	return frames[len(frames)-1].Image
+}
+
+// contactSheet samples up to ContactSheetMaxFrames evenly spaced frames and tiles them into a grid.
+func contactSheet(frames []AnimationFrame) image.Image {
+	count := min(len(frames), ContactSheetMaxFrames)
+	columns := int(math.Ceil(math.Sqrt(float64(count))))
+	rows := (count + columns - 1) / columns
+
+	bounds := frames[0].Image.Bounds()
+	tileWidth := min(ContactSheetTileWidth, bounds.Dx())
+	tileHeight := max(1, bounds.Dy()*tileWidth/max(1, bounds.Dx()))
+
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*tileWidth, rows*tileHeight))
+	// JPEG has no transparency, so fill with white rather than letting transparent pixels turn black.
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	for i := 0; i < count; i++ {
+		frame := frames[i*len(frames)/count].Image
+		x := (i % columns) * tileWidth
+		y := (i / columns) * tileHeight
+		tile := image.Rect(x, y, x+tileWidth, y+tileHeight)
+		draw.BiLinear.Scale(sheet, tile, frame, frame.Bounds(), draw.Over, nil)
+	}
+
+	return sheet
+}
+
+// flattenAnimation applies the configured AnimatedImageMode to an attachment.
+// It returns the image to send along with a note for the message body, or ErrNotAnimated
+// if the caller should decode the attachment as a still image.
+func flattenAnimation(data []byte, mode AnimatedImageMode) (image.Image, string, error) {
+	if mode == AnimatedFirstFrame {
+		return nil, "", ErrNotAnimated
+	}
+
+	frames, err := decodeAnimation(data)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if mode == AnimatedContactSheet {
+		shown := min(len(frames), ContactSheetMaxFrames)
+		return contactSheet(frames), fmt.Sprintf("[The attached image was animated. %d of its %d frames are shown.]", shown, len(frames)), nil
+	}
+
+	return representativeFrame(frames), fmt.Sprintf("[The attached image was animated. 1 of its %d frames is shown.]", len(frames)), nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+)
+
+func encodeTestGIF(_t *testing.T, frames int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 30), palette.Plan9)
+		for x := 0; x < 40; x++ {
+			for y := 0; y < 30; y++ {
+				frame.Set(x, y, color.RGBA{R: uint8(i * 60), A: 0xff})
+			}
+		}
+
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		_t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestAnimatedGIFDecode(_t *testing.T) {
+	frames, err := decodeAnimation(encodeTestGIF(_t, 4))
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	if len(frames) != 4 {
+		_t.Fatalf("Incorrect frame count.\n\n Expected: '%d'\n\n Got: '%d'", 4, len(frames))
+	}
+
+	if frames[0].Duration != 100 {
+		_t.Errorf("Incorrect frame duration.\n\n Expected: '%d'\n\n Got: '%d'", 100, frames[0].Duration)
+	}
+
+	// The halfway point of four equal frames is the end of the second.
+	r, _, _, _ := representativeFrame(frames).At(0, 0).RGBA()
+	expected, _, _, _ := frames[1].Image.At(0, 0).RGBA()
+	if r != expected {
+		_t.Errorf("Incorrect representative frame.\n\n Expected red: '%d'\n\n Got: '%d'", expected, r)
+	}
+}
+
+func TestStillGIFIsNotAnimated(_t *testing.T) {
+	_, err := decodeAnimation(encodeTestGIF(_t, 1))
+	if !errors.Is(err, ErrNotAnimated) {
+		_t.Errorf("Expected ErrNotAnimated, got '%v'", err)
+	}
+
+	_, _, err = flattenAnimation(encodeTestGIF(_t, 4), AnimatedFirstFrame)
+	if !errors.Is(err, ErrNotAnimated) {
+		_t.Errorf("Expected first frame mode to skip flattening, got '%v'", err)
+	}
+}
+
+func TestContactSheet(_t *testing.T) {
+	sheet, note, err := flattenAnimation(encodeTestGIF(_t, 12), AnimatedContactSheet)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	// 12 frames are sampled down to 9, laid out in a 3x3 grid of 40x30 tiles.
+	expected := image.Rect(0, 0, 120, 90)
+	if sheet.Bounds() != expected {
+		_t.Errorf("Incorrect contact sheet size.\n\n Expected: '%v'\n\n Got: '%v'", expected, sheet.Bounds())
+	}
+
+	expectedNote := "[The attached image was animated. 9 of its 12 frames are shown.]"
+	if note != expectedNote {
+		_t.Errorf("Incorrect note.\n\n Expected: '%s'\n\n Got: '%s'", expectedNote, note)
+	}
+}
+
+func TestAnimationLimits(_t *testing.T) {
+	for _, frames := range []int{1, 4, 12} {
+		count, err := countGIFFrames(encodeTestGIF(_t, frames))
+		if err != nil || count != frames {
+			_t.Errorf("Incorrect frame count.\n\n Expected: '%d'\n\n Got: '%d' (%v)", frames, count, err)
+		}
+	}
+
+	_, err := decodeAnimation(encodeTestGIF(_t, MaxAnimationFrames+1))
+	if !errors.Is(err, ErrAnimationTooLarge) {
+		_t.Errorf("Expected too many frames to be rejected, got '%v'", err)
+	}
+
+	// A small file can describe a huge canvas, which every frame would be copied onto.
+	g := &gif.GIF{Config: image.Config{Width: 8000, Height: 8000, ColorModel: color.Palette(palette.Plan9)}}
+	for i := 0; i < 2; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 1, 1), palette.Plan9))
+		g.Delay = append(g.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		_t.Fatal(err)
+	}
+
+	_, err = decodeAnimation(buf.Bytes())
+	if !errors.Is(err, ErrAnimationTooLarge) {
+		_t.Errorf("Expected the canvas to be rejected, got '%v'", err)
+	}
+}
@@ -2,24 +2,133 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/WiiLink24/Mail-Server/secrets"
 	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/argon2"
 )
 
 var (
 	ErrInvalidCredentials = errors.New("an authentication error occurred")
+	ErrInvalidHash        = errors.New("unrecognised credential hash")
+)
+
+const (
+	ValidatePassword   = `SELECT password FROM accounts WHERE mlid = $1`
+	UpdatePasswordHash = `UPDATE accounts SET password = $3 WHERE mlid = $1 AND password = $2`
+	UpdateMlchkidHash  = `UPDATE accounts SET mlchkid = $3 WHERE mlid = $1 AND mlchkid = $2`
 )
 
-const ValidatePassword = `SELECT password FROM accounts WHERE mlid = $1 AND password = $2`
+// Credential hashes are versioned by their prefix. Hashes without one are the original unsalted SHA-512,
+// which are upgraded the next time the console authenticates.
+const (
+	Argon2idPrefix    = "$argon2id$"
+	MlchkidHMACPrefix = "$hmac-sha256$"
+)
 
-// hashPassword hashes the mlchkid for usage in the database.
+// Argon2Params are the cost parameters passwd hashes are created with.
+// Hashes made with other parameters are rehashed on the next successful login.
+type Argon2Params struct {
+	Memory     uint32
+	Time       uint32
+	Threads    uint8
+	SaltLength int
+	KeyLength  uint32
+}
+
+// passwdParams follows the OWASP recommendation for argon2id. Consoles authenticate on every
+// send and receive, so this is kept low enough to not need much memory per request.
+var passwdParams = Argon2Params{
+	Memory:     19 * 1024,
+	Time:       2,
+	Threads:    1,
+	SaltLength: 16,
+	KeyLength:  32,
+}
+
+// hashPassword hashes a secret with unsalted SHA-512. It is only suitable for high entropy values such as tokens,
+// and is how passwd and mlchkid were originally stored.
 func hashPassword(password string) string {
 	hashByte := sha512.Sum512([]byte(password))
 	return hex.EncodeToString(hashByte[:])
 }
 
+// hashPasswd hashes a passwd with argon2id and a random salt, encoded in the PHC string format.
+func hashPasswd(passwd string) string {
+	salt := secrets.Bytes(passwdParams.SaltLength)
+
+	key := argon2.IDKey([]byte(passwd), salt, passwdParams.Time, passwdParams.Memory, passwdParams.Threads, passwdParams.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", Argon2idPrefix, argon2.Version, passwdParams.Memory, passwdParams.Time, passwdParams.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// verifyPasswd checks a passwd against its stored hash in constant time.
+// needsRehash is set when the hash is valid but was not made with the current scheme and parameters.
+func verifyPasswd(passwd, stored string) (ok bool, needsRehash bool, err error) {
+	if !strings.HasPrefix(stored, Argon2idPrefix) {
+		if len(stored) != sha512.Size*2 {
+			return false, false, ErrInvalidHash
+		}
+
+		ok = subtle.ConstantTimeCompare([]byte(hashPassword(passwd)), []byte(stored)) == 1
+		return ok, true, nil
+	}
+
+	var version int
+	var params Argon2Params
+	parts := strings.Split(strings.TrimPrefix(stored, Argon2idPrefix), "$")
+	if len(parts) != 4 {
+		return false, false, ErrInvalidHash
+	}
+
+	_, err = fmt.Sscanf(parts[0], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, false, ErrInvalidHash
+	}
+
+	_, err = fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return false, false, ErrInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, false, ErrInvalidHash
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, false, ErrInvalidHash
+	}
+
+	key := argon2.IDKey([]byte(passwd), salt, params.Time, params.Memory, params.Threads, uint32(len(expected)))
+	ok = subtle.ConstantTimeCompare(key, expected) == 1
+	needsRehash = params.Memory != passwdParams.Memory || params.Time != passwdParams.Time || params.Threads != passwdParams.Threads ||
+		len(salt) != passwdParams.SaltLength || uint32(len(expected)) != passwdParams.KeyLength
+	return ok, needsRehash, nil
+}
+
+// hashMlchkid hashes an mlchkid with MlchkidKey. check.cgi looks accounts up by this hash,
+// so unlike passwd it cannot be salted. Without a key, the original unsalted SHA-512 is used.
+func hashMlchkid(mlchkid string) string {
+	if config.MlchkidKey == "" {
+		return hashPassword(mlchkid)
+	}
+
+	h := hmac.New(sha256.New, []byte(config.MlchkidKey))
+	h.Write([]byte(mlchkid))
+	return MlchkidHMACPrefix + hex.EncodeToString(h.Sum(nil))
+}
+
 // From https://github.com/RiiConnect24/Mail-Go/blob/master/auth.go#L28
 // parseSendAuth obtains a mlid and passwd from the given format.
 // If it is unable to do so, it returns empty strings for both.
@@ -38,23 +147,72 @@ func parseSendAuth(format string) (string, string) {
 	}
 }
 
-func validatePassword(ctx context.Context, mlid, password string) error {
+// validatePassword checks the credentials of a Wii, then whether it or the IP it connected from is suspended.
+// A *BanError is returned for suspended Wiis. Repeated failures from an IP are delayed, then locked out.
+func validatePassword(ctx context.Context, mlid, password, ip string) error {
+	delay, err := authLimiter.Check(mlid, ip)
+	if err != nil {
+		recordAuthFailure(ctx, mlid, ip, "locked")
+		return err
+	}
+
+	err = sleepContext(ctx, delay)
+	if err != nil {
+		return err
+	}
+
+	reason, err := verifyCredentials(ctx, mlid, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		authLimiter.Fail(mlid, ip)
+		recordAuthFailure(ctx, mlid, ip, reason)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	authLimiter.Succeed(mlid, ip)
+	return checkBans(ctx, mlid[1:], ip)
+}
+
+// verifyCredentials checks a passwd against the one stored for an mlid, upgrading its hash if needed.
+// Unknown mlids take as long as hashing a passwd, so they cannot be told apart from wrong passwds by timing.
+// Malformed requests are rejected straight away, as they reveal nothing and would otherwise cost as much as a login.
+// The reason for an ErrInvalidCredentials is returned for metrics, and must not be shown to the console.
+func verifyCredentials(ctx context.Context, mlid, password string) (string, error) {
 	if mlid == "" || password == "" {
-		return ErrInvalidCredentials
+		return "missing", ErrInvalidCredentials
 	}
 
 	if !validateFriendCode(mlid[1:]) {
-		return ErrInvalidCredentials
+		return "invalid_mlid", ErrInvalidCredentials
 	}
 
-	hash := hashPassword(password)
-	row := pool.QueryRow(ctx, ValidatePassword, mlid[1:], hash)
-	err := row.Scan(nil)
+	var stored string
+	row := pool.QueryRow(ctx, ValidatePassword, mlid[1:])
+	err := row.Scan(&stored)
 	if errors.Is(err, pgx.ErrNoRows) {
-		return ErrInvalidCredentials
+		hashPasswd(password)
+		return "unknown_mlid", ErrInvalidCredentials
 	} else if err != nil {
-		return err
+		return "", err
+	}
+
+	ok, needsRehash, err := verifyPasswd(password, stored)
+	if err != nil {
+		return "", err
+	}
+
+	if !ok {
+		return "wrong_passwd", ErrInvalidCredentials
+	}
+
+	if needsRehash {
+		// Another request may have upgraded it already, in which case this does nothing.
+		_, err = pool.Exec(ctx, UpdatePasswordHash, mlid[1:], stored, hashPasswd(password))
+		if err != nil {
+			return "", err
+		}
 	}
 
-	return nil
+	return "", nil
 }
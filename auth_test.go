@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestVerifyPasswd(_t *testing.T) {
+	hash := hashPasswd("passwd")
+	if !strings.HasPrefix(hash, Argon2idPrefix) {
+		_t.Fatalf("Expected an argon2id hash, got '%s'", hash)
+	}
+
+	if hashPasswd("passwd") == hash {
+		_t.Errorf("Two hashes of the same passwd used the same salt")
+	}
+
+	cases := []struct {
+		name        string
+		passwd      string
+		stored      string
+		ok          bool
+		needsRehash bool
+	}{
+		{"current", "passwd", hash, true, false},
+		{"current wrong passwd", "wrong", hash, false, false},
+		{"legacy", "passwd", hashPassword("passwd"), true, true},
+		{"legacy wrong passwd", "wrong", hashPassword("passwd"), false, true},
+		{"old parameters", "passwd", "$argon2id$v=19$m=8,t=1,p=1$c2FsdHNhbHQ$4hh5nv2t9hGzWC6D+v+6Qw", true, true},
+	}
+
+	for _, tc := range cases {
+		ok, needsRehash, err := verifyPasswd(tc.passwd, tc.stored)
+		if err != nil {
+			_t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if ok != tc.ok || needsRehash != tc.needsRehash {
+			_t.Errorf("%s: expected ok=%v needsRehash=%v, got ok=%v needsRehash=%v", tc.name, tc.ok, tc.needsRehash, ok, needsRehash)
+		}
+	}
+
+	for _, invalid := range []string{"", "plaintext", "$argon2id$v=19$m=8,t=1,p=1$c2FsdA", "$argon2id$v=16$m=8,t=1,p=1$c2FsdA$c2FsdA"} {
+		if _, _, err := verifyPasswd("passwd", invalid); err == nil {
+			_t.Errorf("Expected '%s' to be rejected", invalid)
+		}
+	}
+}
+
+func TestHashMlchkid(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	mlchkid := "abcdefghijklmnopqrstuvwxyzABCDEF"
+	if hashMlchkid(mlchkid) != hashPassword(mlchkid) {
+		_t.Errorf("Expected the original hash without a MlchkidKey")
+	}
+
+	config.MlchkidKey = "first key"
+	first := hashMlchkid(mlchkid)
+	if !strings.HasPrefix(first, MlchkidHMACPrefix) || first != hashMlchkid(mlchkid) {
+		_t.Errorf("Incorrect mlchkid hash '%s'", first)
+	}
+
+	config.MlchkidKey = "second key"
+	if hashMlchkid(mlchkid) == first {
+		_t.Errorf("Different keys produced the same mlchkid hash")
+	}
+}
+
+func TestVerifyCredentialsMalformed(_t *testing.T) {
+	// These are rejected before the database is queried, so no pool is needed.
+	cases := map[string][2]string{
+		"missing":      {"", "abcdefghijklmnop"},
+		"invalid_mlid": {"w1234567890123456", "abcdefghijklmnop"},
+	}
+
+	for expected, credentials := range cases {
+		reason, err := verifyCredentials(context.Background(), credentials[0], credentials[1])
+		if reason != expected || !errors.Is(err, ErrInvalidCredentials) {
+			_t.Errorf("Incorrect result.\n\n Expected: '%s'\n\n Got: '%s' (%v)", expected, reason, err)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	sentrygin "github.com/getsentry/sentry-go/gin"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// DefaultAuthDelayAfter is how many consecutive failures are allowed before responses are delayed.
+	DefaultAuthDelayAfter = 3
+	// DefaultMlidLockoutFailures is how many consecutive failures for an mlid from one IP lock that IP out of the mlid.
+	// DefaultIPLockoutFailures is how many from one IP, for any mlid, lock the IP out entirely.
+	DefaultMlidLockoutFailures = 10
+	DefaultIPLockoutFailures   = 50
+	DefaultAuthLockoutMinutes  = 15
+
+	AuthBaseDelay = 250 * time.Millisecond
+	AuthMaxDelay  = 4 * time.Second
+
+	// authSweepSize is how many counters are kept before expired ones are removed.
+	authSweepSize = 10000
+)
+
+// ErrAuthLocked is returned while an IP is locked out. It is also an ErrInvalidCredentials,
+// so consoles are told the same thing as for a wrong passwd.
+var ErrAuthLocked = fmt.Errorf("%w: too many failed attempts, try again later", ErrInvalidCredentials)
+
+type authFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// AuthLimiter counts consecutive authentication failures per mlid and IP, and per IP.
+// Wii numbers are public, so failures are never counted against an mlid alone. Otherwise anyone could lock
+// the owner out by sending wrong passwords.
+type AuthLimiter struct {
+	mu       sync.Mutex
+	counters map[string]*authFailures
+	now      func() time.Time
+}
+
+var authLimiter = NewAuthLimiter()
+
+func NewAuthLimiter() *AuthLimiter {
+	return &AuthLimiter{
+		counters: map[string]*authFailures{},
+		now:      time.Now,
+	}
+}
+
+func authLockout() time.Duration {
+	if config.AuthLimits.LockoutMinutes > 0 {
+		return time.Duration(config.AuthLimits.LockoutMinutes) * time.Minute
+	}
+
+	return DefaultAuthLockoutMinutes * time.Minute
+}
+
+func authLimit(configured, fallback int) int {
+	if configured > 0 {
+		return configured
+	}
+
+	return fallback
+}
+
+// counter returns the failures for key, forgetting them once they are older than the lockout window.
+func (l *AuthLimiter) counter(key string, now time.Time) *authFailures {
+	counter, ok := l.counters[key]
+	if !ok || (now.Sub(counter.last) > authLockout() && now.After(counter.lockedUntil)) {
+		return &authFailures{}
+	}
+
+	return counter
+}
+
+// mlidKey is the counter for failures at an mlid from one IP.
+func mlidKey(mlid, ip string) string {
+	return "mlid:" + mlid + "@" + ip
+}
+
+// Check returns ErrAuthLocked if the IP is locked out, either entirely or from the mlid,
+// otherwise how long to wait before verifying the credentials.
+func (l *AuthLimiter) Check(mlid, ip string) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	mlidFailures := l.counter(mlidKey(mlid, ip), now)
+	ipFailures := l.counter("ip:"+ip, now)
+	if now.Before(mlidFailures.lockedUntil) || now.Before(ipFailures.lockedUntil) {
+		return 0, ErrAuthLocked
+	}
+
+	failures := max(mlidFailures.count, ipFailures.count)
+	delayAfter := authLimit(config.AuthLimits.DelayAfter, DefaultAuthDelayAfter)
+	if failures < delayAfter {
+		return 0, nil
+	}
+
+	delay := AuthBaseDelay << min(failures-delayAfter, 8)
+	return min(delay, AuthMaxDelay), nil
+}
+
+// Fail records a failed attempt, locking the IP out of the mlid, or out entirely, once it has failed too many times in a row.
+func (l *AuthLimiter) Fail(mlid, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if len(l.counters) > authSweepSize {
+		for key, counter := range l.counters {
+			if now.Sub(counter.last) > authLockout() && now.After(counter.lockedUntil) {
+				delete(l.counters, key)
+			}
+		}
+	}
+
+	l.fail(mlidKey(mlid, ip), authLimit(config.AuthLimits.MlidLockoutFailures, DefaultMlidLockoutFailures), now)
+	if ip != "" {
+		l.fail("ip:"+ip, authLimit(config.AuthLimits.IPLockoutFailures, DefaultIPLockoutFailures), now)
+	}
+}
+
+func (l *AuthLimiter) fail(key string, lockoutAfter int, now time.Time) {
+	counter := l.counter(key, now)
+	counter.count++
+	counter.last = now
+	if counter.count >= lockoutAfter {
+		counter.lockedUntil = now.Add(authLockout())
+		counter.count = 0
+	}
+
+	l.counters[key] = counter
+}
+
+// Succeed clears the failures for an mlid from an IP. Failures for the IP itself are kept, otherwise anyone with
+// one valid account could reset their IP's counter between guesses at another.
+func (l *AuthLimiter) Succeed(mlid, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.counters, mlidKey(mlid, ip))
+}
+
+// recordAuthFailure reports a failed authentication to Datadog and as a Sentry breadcrumb.
+// Only the mlid, IP and reason are recorded, never the credentials given.
+func recordAuthFailure(ctx context.Context, mlid, ip, reason string) {
+	if config.UseDatadog {
+		err := dataDog.Incr("mail.auth_failed", []string{"reason:" + reason}, 1)
+		if err != nil {
+			ReportErrorGlobal(err)
+		}
+	}
+
+	hub := sentry.CurrentHub()
+	if c, ok := ctx.(*gin.Context); ok {
+		if requestHub := sentrygin.GetHubFromContext(c); requestHub != nil {
+			hub = requestHub
+		}
+	}
+
+	hub.AddBreadcrumb(&sentry.Breadcrumb{
+		Category: "auth",
+		Message:  "Authentication failed",
+		Level:    sentry.LevelWarning,
+		Data: map[string]any{
+			"mlid":   mlid,
+			"ip":     ip,
+			"reason": reason,
+		},
+	}, nil)
+}
+
+// sleepContext waits for d, returning early if ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAuthLimiter(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewAuthLimiter()
+	limiter.now = func() time.Time { return now }
+
+	mlid, ip := "w1234567890123456", "192.0.2.1"
+	expected := []time.Duration{0, 0, 0, AuthBaseDelay, 2 * AuthBaseDelay, 4 * AuthBaseDelay, 8 * AuthBaseDelay, 16 * AuthBaseDelay, AuthMaxDelay, AuthMaxDelay}
+	for failures, want := range expected {
+		delay, err := limiter.Check(mlid, ip)
+		if err != nil {
+			_t.Fatalf("Locked out after %d failures: %v", failures, err)
+		}
+
+		if delay != want {
+			_t.Errorf("Incorrect delay after %d failures.\n\n Expected: '%s'\n\n Got: '%s'", failures, want, delay)
+		}
+
+		limiter.Fail(mlid, ip)
+	}
+
+	if _, err := limiter.Check(mlid, ip); !errors.Is(err, ErrAuthLocked) || !errors.Is(err, ErrInvalidCredentials) {
+		_t.Errorf("Expected the IP to be locked out of the mlid, got %v", err)
+	}
+
+	// Wii numbers are public, so failures from one IP must not lock the owner out from theirs.
+	if delay, err := limiter.Check(mlid, "198.51.100.1"); err != nil || delay != 0 {
+		_t.Errorf("Expected the mlid to be usable from another IP, got %s, %v", delay, err)
+	}
+
+	// The IP has failed 10 times, which delays other mlids from it but does not lock them out.
+	if delay, err := limiter.Check("w6543210987654321", ip); err != nil || delay != AuthMaxDelay {
+		_t.Errorf("Expected another mlid from the IP to be delayed, got %s, %v", delay, err)
+	}
+
+	now = now.Add(DefaultAuthLockoutMinutes*time.Minute + time.Second)
+	if delay, err := limiter.Check(mlid, ip); err != nil || delay != 0 {
+		_t.Errorf("Expected the lockout to have expired, got %s, %v", delay, err)
+	}
+
+	limiter.Fail(mlid, "198.51.100.1")
+	limiter.Fail(mlid, "198.51.100.1")
+	limiter.Fail(mlid, "198.51.100.1")
+	limiter.Succeed(mlid, "198.51.100.1")
+	if delay, _ := limiter.Check(mlid, "198.51.100.1"); delay != AuthBaseDelay {
+		_t.Errorf("Expected a successful login to clear the mlid's failures but not the IP's, got %s", delay)
+	}
+
+	// Enough failures from one IP at different mlids lock the IP out of all of them.
+	for i := 0; i < DefaultIPLockoutFailures; i++ {
+		limiter.Fail(fmt.Sprintf("w%016d", i), "203.0.113.1")
+	}
+
+	if _, err := limiter.Check(mlid, "203.0.113.1"); !errors.Is(err, ErrAuthLocked) {
+		_t.Errorf("Expected the IP to be locked out, got %v", err)
+	}
+}
@@ -0,0 +1,606 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	InsertBroadcast = `INSERT INTO broadcasts (data, sender, selector, mlids, active_since, community_id, total, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+	// QueryBroadcastRecipients returns the next accounts after $1 in mlid order, so a broadcast can carry on where it stopped.
+	QueryBroadcastRecipients = `SELECT mlid FROM accounts a WHERE mlid > $1
+		AND ($3::text[] IS NULL OR mlid = ANY($3))
+		AND ($4::bigint IS NULL OR EXISTS (SELECT 1 FROM mail WHERE sender = a.mlid AND snowflake >= $4))
+		AND ($5::bigint IS NULL OR EXISTS (SELECT 1 FROM community_subscriptions WHERE community_id = $5 AND mlid = a.mlid))
+		ORDER BY mlid LIMIT $2`
+	CountBroadcastRecipients = `SELECT COUNT(*) FROM accounts a WHERE ($1::text[] IS NULL OR mlid = ANY($1))
+		AND ($2::bigint IS NULL OR EXISTS (SELECT 1 FROM mail WHERE sender = a.mlid AND snowflake >= $2))
+		AND ($3::bigint IS NULL OR EXISTS (SELECT 1 FROM community_subscriptions WHERE community_id = $3 AND mlid = a.mlid))`
+	LockBroadcast = `SELECT status, last_mlid, sender, mlids, active_since, community_id FROM broadcasts WHERE id = $1 FOR UPDATE`
+	// InsertBroadcastMail queues a batch in one statement. The body is not copied, each row refers to the broadcast.
+	InsertBroadcastMail = `INSERT INTO mail (snowflake, sender, recipient, is_sent, broadcast_id)
+		SELECT snowflake, $2, recipient, false, $3 FROM unnest($1::bigint[], $4::text[]) AS batch (snowflake, recipient)`
+	UpdateBroadcastProgress = `UPDATE broadcasts SET last_mlid = $2, sent = sent + $3 WHERE id = $1`
+	FinishBroadcast         = `UPDATE broadcasts SET status = 'done', finished_at = now() WHERE id = $1`
+	UpdateBroadcastStatus   = `UPDATE broadcasts SET status = $3 WHERE id = $1 AND status = $2`
+	QueryBroadcast          = `SELECT id, selector, status, sent, total, created_by, created_at, finished_at FROM broadcasts WHERE id = $1`
+	QueryCommunityBroadcast = `SELECT id, selector, status, sent, total, created_by, created_at, finished_at FROM broadcasts
+		WHERE id = $1 AND community_id = $2`
+	QueryBroadcasts = `SELECT id, selector, status, sent, total, created_by, created_at, finished_at FROM broadcasts
+		ORDER BY id DESC LIMIT 100`
+	QueryRunningBroadcasts = `SELECT id FROM broadcasts WHERE status = 'running'`
+
+	BroadcastRunning = "running"
+	BroadcastPaused  = "paused"
+	BroadcastDone    = "done"
+
+	DefaultBroadcastBatchSize = 1000
+)
+
+var (
+	ErrBroadcastNotFound   = errors.New("broadcast does not exist")
+	ErrBroadcastNotRunning = errors.New("broadcast is not running")
+	ErrBroadcastNotPaused  = errors.New("broadcast is not paused")
+)
+
+// runningBroadcasts holds the broadcasts this server is sending, so each is only sent by one goroutine.
+// Other servers may send the same broadcast, which is safe as each batch locks it.
+var runningBroadcasts sync.Map
+
+// BroadcastSelector chooses which accounts a broadcast is sent to. The zero value sends to every account.
+type BroadcastSelector struct {
+	// Mlids limits the broadcast to these accounts, without their w.
+	Mlids []string
+	// ActiveDays limits the broadcast to accounts that have sent mail in the last ActiveDays days.
+	ActiveDays int
+	// Community limits the broadcast to its subscribers, and sends it from the community's address.
+	Community *Community
+}
+
+func (s BroadcastSelector) String() string {
+	var parts []string
+	if s.Mlids != nil {
+		parts = append(parts, fmt.Sprintf("%d listed accounts", len(s.Mlids)))
+	}
+
+	if s.ActiveDays > 0 {
+		parts = append(parts, fmt.Sprintf("active in the last %d days", s.ActiveDays))
+	}
+
+	if s.Community != nil {
+		parts = append(parts, "subscribers of "+s.Community.Slug)
+	}
+
+	if len(parts) == 0 {
+		return "all accounts"
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Broadcast is a message being sent to many accounts, and how far it has got.
+type Broadcast struct {
+	ID         int64      `json:"id"`
+	Selector   string     `json:"selector"`
+	Status     string     `json:"status"`
+	Sent       int64      `json:"sent"`
+	Total      int64      `json:"total"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func scanBroadcast(row pgx.Row) (Broadcast, error) {
+	var b Broadcast
+	err := row.Scan(&b.ID, &b.Selector, &b.Status, &b.Sent, &b.Total, &b.CreatedBy, &b.CreatedAt, &b.FinishedAt)
+	return b, err
+}
+
+func broadcastSender() string {
+	if config.Broadcasts.Sender != "" {
+		return config.Broadcasts.Sender
+	}
+
+	return "announcements@" + primaryDomain()
+}
+
+func broadcastBatchSize() int {
+	return intervalSetting(config.Broadcasts.BatchSize, DefaultBroadcastBatchSize)
+}
+
+// parseMlidList parses Wii numbers separated by commas or whitespace, with or without their w.
+func parseMlidList(list string) ([]string, error) {
+	var mlids []string
+	for _, mlid := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\t' || r == '\r' }) {
+		mlid = strings.TrimPrefix(strings.ToLower(mlid), "w")
+		if !validateFriendCode(mlid) {
+			return nil, fmt.Errorf("invalid Wii number %s", mlid)
+		}
+
+		mlids = append(mlids, mlid)
+	}
+
+	if len(mlids) == 0 {
+		return nil, errors.New("no Wii numbers were given")
+	}
+
+	return mlids, nil
+}
+
+// createBroadcast stores a message once along with who it is for, ready to be sent by runBroadcast.
+func createBroadcast(ctx context.Context, subject string, msg *Message, selector BroadcastSelector, actor string) (Broadcast, error) {
+	sender := broadcastSender()
+	var communityID *int64
+	if selector.Community != nil {
+		sender = communityAddress(selector.Community.Slug)
+		communityID = &selector.Community.ID
+	}
+
+	formulatedMail, err := formulateMessage(sender, sender, subject, msg)
+	if err != nil {
+		return Broadcast{}, err
+	}
+
+	var activeSince *int64
+	if selector.ActiveDays > 0 {
+		since := snowflakeAt(time.Now().AddDate(0, 0, -selector.ActiveDays))
+		activeSince = &since
+	}
+
+	var total int64
+	err = pool.QueryRow(ctx, CountBroadcastRecipients, selector.Mlids, activeSince, communityID).Scan(&total)
+	if err != nil {
+		return Broadcast{}, err
+	}
+
+	var id int64
+	err = pool.QueryRow(ctx, InsertBroadcast, formulatedMail, sender, selector.String(), selector.Mlids, activeSince, communityID, total, actor).Scan(&id)
+	if err != nil {
+		return Broadcast{}, err
+	}
+
+	log.Printf("Broadcast %d to %s (%d accounts) created by %s", id, selector, total, actor)
+	return scanBroadcast(pool.QueryRow(ctx, QueryBroadcast, id))
+}
+
+// sendBroadcastBatch queues the broadcast for the next batch of accounts. It returns how many were queued,
+// and whether the broadcast is finished or has been paused. The batch and the progress are saved together,
+// so a broadcast that is interrupted carries on without sending anything twice.
+func sendBroadcastBatch(ctx context.Context, id int64) (int, bool, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var status, lastMlid, sender string
+	var mlids []string
+	var activeSince, communityID *int64
+	err = tx.QueryRow(ctx, LockBroadcast, id).Scan(&status, &lastMlid, &sender, &mlids, &activeSince, &communityID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, ErrBroadcastNotFound
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	if status != BroadcastRunning {
+		return 0, true, nil
+	}
+
+	rows, err := tx.Query(ctx, QueryBroadcastRecipients, lastMlid, broadcastBatchSize(), mlids, activeSince, communityID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	recipients, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, false, err
+	}
+
+	if len(recipients) == 0 {
+		_, err = tx.Exec(ctx, FinishBroadcast, id)
+		if err != nil {
+			return 0, false, err
+		}
+
+		return 0, true, tx.Commit(ctx)
+	}
+
+	snowflakes := make([]int64, len(recipients))
+	for i := range recipients {
+		snowflakes[i] = flakeNode.Generate().Int64()
+	}
+
+	_, err = tx.Exec(ctx, InsertBroadcastMail, snowflakes, sender, id, recipients)
+	if err != nil {
+		return 0, false, err
+	}
+
+	_, err = tx.Exec(ctx, UpdateBroadcastProgress, id, recipients[len(recipients)-1], len(recipients))
+	if err != nil {
+		return 0, false, err
+	}
+
+	// The trigger on mail skips broadcasts, so servers are told about the whole batch at once when it is committed.
+	event, err := json.Marshal(MailEvent{
+		Type:      MailEventBroadcast,
+		Snowflake: strconv.FormatInt(snowflakes[0], 10),
+		Sender:    sender,
+		Broadcast: id,
+		FirstMlid: recipients[0],
+		LastMlid:  recipients[len(recipients)-1],
+		Queued:    len(recipients),
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	_, err = tx.Exec(ctx, NotifyMailEvent, MailEventsChannel, string(event))
+	if err != nil {
+		return 0, false, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+
+	for i, mlid := range recipients {
+		checkCache.MailQueued(mlid, snowflakes[i])
+	}
+
+	return len(recipients), false, nil
+}
+
+// runBroadcast sends a broadcast in batches until it is finished or paused. progress is called after each batch.
+func runBroadcast(ctx context.Context, id int64, progress func(queued int)) error {
+	for ctx.Err() == nil {
+		queued, stopped, err := sendBroadcastBatch(ctx, id)
+		if err != nil || stopped {
+			return err
+		}
+
+		if config.UseDatadog {
+			err = dataDog.Incr("mail.broadcast_mail", nil, float64(queued))
+			if err != nil {
+				ReportErrorGlobal(err)
+			}
+		}
+
+		if progress != nil {
+			progress(queued)
+		}
+	}
+
+	return ctx.Err()
+}
+
+// startBroadcast sends a broadcast in the background, unless this server is already sending it.
+func startBroadcast(id int64) {
+	if _, running := runningBroadcasts.LoadOrStore(id, struct{}{}); running {
+		return
+	}
+
+	go func() {
+		defer runningBroadcasts.Delete(id)
+
+		err := runBroadcast(ctx, id, nil)
+		if err != nil && ctx.Err() == nil {
+			ReportErrorGlobal(fmt.Errorf("broadcast %d: %w", id, err))
+			return
+		}
+
+		log.Printf("Broadcast %d stopped", id)
+	}()
+}
+
+// resumeBroadcasts carries on sending broadcasts that were running when the server last stopped.
+func resumeBroadcasts() {
+	rows, err := pool.Query(ctx, QueryRunningBroadcasts)
+	if err != nil {
+		ReportErrorGlobal(err)
+		return
+	}
+
+	ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		ReportErrorGlobal(err)
+		return
+	}
+
+	for _, id := range ids {
+		log.Printf("Resuming broadcast %d", id)
+		startBroadcast(id)
+	}
+}
+
+// setBroadcastStatus pauses or resumes a broadcast, returning notCurrent if it was not in the status expected.
+func setBroadcastStatus(ctx context.Context, id int64, from, to string, notCurrent error) error {
+	tag, err := pool.Exec(ctx, UpdateBroadcastStatus, id, from, to)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return notCurrent
+	}
+
+	return nil
+}
+
+func pauseBroadcast(ctx context.Context, id int64) error {
+	return setBroadcastStatus(ctx, id, BroadcastRunning, BroadcastPaused, ErrBroadcastNotRunning)
+}
+
+func resumeBroadcast(ctx context.Context, id int64) error {
+	return setBroadcastStatus(ctx, id, BroadcastPaused, BroadcastRunning, ErrBroadcastNotPaused)
+}
+
+func adminBroadcastID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid broadcast id"})
+		return 0, false
+	}
+
+	return id, true
+}
+
+// adminCreateBroadcast starts a broadcast. It takes a form read by composedMessage, along with optional
+// mlids, active_days and actor fields. Without mlids or active_days it is sent to every account.
+func adminCreateBroadcast(c *gin.Context) {
+	var selector BroadcastSelector
+	if list := c.PostForm("mlids"); list != "" {
+		mlids, err := parseMlidList(list)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		selector.Mlids = mlids
+	}
+
+	if days := c.PostForm("active_days"); days != "" {
+		var err error
+		selector.ActiveDays, err = strconv.Atoi(days)
+		if err != nil || selector.ActiveDays <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "active_days must be a positive number"})
+			return
+		}
+	}
+
+	subject, msg, ok := composedMessage(c)
+	if !ok {
+		return
+	}
+
+	broadcast, err := createBroadcast(c, subject, msg, selector, c.PostForm("actor"))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	startBroadcast(broadcast.ID)
+	c.JSON(http.StatusAccepted, broadcast)
+}
+
+func adminListBroadcasts(c *gin.Context) {
+	rows, err := pool.Query(c, QueryBroadcasts)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	broadcasts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Broadcast, error) {
+		return scanBroadcast(row)
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"broadcasts": broadcasts})
+}
+
+func adminGetBroadcast(c *gin.Context) {
+	id, ok := adminBroadcastID(c)
+	if !ok {
+		return
+	}
+
+	broadcast, err := scanBroadcast(pool.QueryRow(c, QueryBroadcast, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrBroadcastNotFound.Error()})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, broadcast)
+}
+
+func adminPauseBroadcast(c *gin.Context) {
+	id, ok := adminBroadcastID(c)
+	if !ok {
+		return
+	}
+
+	err := pauseBroadcast(c, id)
+	if errors.Is(err, ErrBroadcastNotRunning) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	adminGetBroadcast(c)
+}
+
+func adminResumeBroadcast(c *gin.Context) {
+	id, ok := adminBroadcastID(c)
+	if !ok {
+		return
+	}
+
+	err := resumeBroadcast(c, id)
+	if errors.Is(err, ErrBroadcastNotPaused) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	startBroadcast(id)
+	adminGetBroadcast(c)
+}
+
+// runBroadcastCommand handles the broadcast admin subcommand. Broadcasts are sent in the foreground,
+// and pausing one stops it wherever it is being sent.
+//
+//	broadcast create [-active days] [-mlids list] [-actor name] <file.eml>
+//	broadcast pause <id>
+//	broadcast resume <id>
+//	broadcast list
+func runBroadcastCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: broadcast <create|pause|resume|list> ...")
+	}
+
+	flags := flag.NewFlagSet("broadcast "+args[0], flag.ContinueOnError)
+	activeDays := flags.Int("active", 0, "only send to accounts that sent mail in this many days")
+	mlidList := flags.String("mlids", "", "only send to these Wii numbers, separated by commas")
+	actor := flags.String("actor", os.Getenv("USER"), "operator responsible for the broadcast")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	var id int64
+	if args[0] == "pause" || args[0] == "resume" {
+		if flags.NArg() != 1 {
+			return fmt.Errorf("usage: broadcast %s <id>", args[0])
+		}
+
+		id, err = strconv.ParseInt(flags.Arg(0), 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch args[0] {
+	case "create":
+		if flags.NArg() != 1 {
+			return errors.New("usage: broadcast create [-active days] [-mlids list] [-actor name] <file.eml>")
+		}
+
+		selector := BroadcastSelector{ActiveDays: *activeDays}
+		if *mlidList != "" {
+			selector.Mlids, err = parseMlidList(*mlidList)
+			if err != nil {
+				return err
+			}
+		}
+
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		msg, err := readMessage(file)
+		if err != nil {
+			return err
+		}
+
+		broadcast, err := createBroadcast(ctx, msg.Subject, msg, selector, *actor)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Created broadcast %d to %s, %d accounts.\n", broadcast.ID, broadcast.Selector, broadcast.Total)
+		return followBroadcast(broadcast.ID, broadcast.Total)
+	case "pause":
+		err = pauseBroadcast(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Paused broadcast %d.\n", id)
+	case "resume":
+		err = resumeBroadcast(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		broadcast, err := scanBroadcast(pool.QueryRow(ctx, QueryBroadcast, id))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Resumed broadcast %d at %d of %d accounts.\n", id, broadcast.Sent, broadcast.Total)
+		return followBroadcast(id, broadcast.Total-broadcast.Sent)
+	case "list":
+		rows, err := pool.Query(ctx, QueryBroadcasts)
+		if err != nil {
+			return err
+		}
+
+		broadcasts, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (Broadcast, error) {
+			return scanBroadcast(row)
+		})
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTO\tSTATUS\tSENT\tBY\tCREATED\tFINISHED")
+		for _, b := range broadcasts {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d/%d\t%s\t%s\t%s\n", b.ID, b.Selector, b.Status, b.Sent, b.Total, b.CreatedBy,
+				b.CreatedAt.Format(time.DateTime), formatOptionalTime(b.FinishedAt))
+		}
+
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown broadcast command %s", args[0])
+	}
+
+	return nil
+}
+
+// followBroadcast sends a broadcast in the foreground, printing its progress.
+func followBroadcast(id, remaining int64) error {
+	var queued int64
+	err := runBroadcast(ctx, id, func(batch int) {
+		queued += int64(batch)
+		fmt.Printf("Queued %d of %d.\n", queued, remaining)
+	})
+	if err != nil {
+		return err
+	}
+
+	broadcast, err := scanBroadcast(pool.QueryRow(ctx, QueryBroadcast, id))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Broadcast %d is %s after queueing %d messages.\n", id, broadcast.Status, broadcast.Sent)
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestParseMlidList(_t *testing.T) {
+	mlids, err := parseMlidList("w1000000000000016, 1000000000000017\nW1000000000000016")
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	expected := "1000000000000016,1000000000000017,1000000000000016"
+	if strings.Join(mlids, ",") != expected {
+		_t.Errorf("Incorrect mlids.\n\n Expected: '%s'\n\n Got: '%s'", expected, strings.Join(mlids, ","))
+	}
+
+	for _, invalid := range []string{"", " , ", "w1000000000000016,w1234"} {
+		if _, err := parseMlidList(invalid); err == nil {
+			_t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestBroadcastSelector(_t *testing.T) {
+	cases := []struct {
+		selector BroadcastSelector
+		expected string
+	}{
+		{BroadcastSelector{}, "all accounts"},
+		{BroadcastSelector{ActiveDays: 30}, "active in the last 30 days"},
+		{BroadcastSelector{Mlids: []string{"1000000000000016", "1000000000000017"}, ActiveDays: 7}, "2 listed accounts, active in the last 7 days"},
+		{BroadcastSelector{Community: &Community{Slug: "news"}}, "subscribers of news"},
+	}
+
+	for _, tc := range cases {
+		if got := tc.selector.String(); got != tc.expected {
+			_t.Errorf("Incorrect description.\n\n Expected: '%s'\n\n Got: '%s'", tc.expected, got)
+		}
+	}
+}
+
+// TestBroadcastPauseResume checks a broadcast paused between batches carries on without sending to anyone twice.
+func TestBroadcastPauseResume(_t *testing.T) {
+	config = &Config{Broadcasts: BroadcastConfig{BatchSize: 2}}
+	previousCache := checkCache
+	defer func() {
+		config = nil
+		checkCache = previousCache
+	}()
+	testDatabase(_t)
+	checkCache = NewCheckCache()
+
+	mlids := []string{"1000000000000016", "1000000000000017", "1111222233334444", "5555666677778888", "9999000011112222"}
+	createTestAccounts(_t, mlids...)
+
+	broadcast, err := createBroadcast(context.Background(), "Announcement", &Message{Text: "Hello"}, BroadcastSelector{Mlids: mlids}, "test")
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	queued, stopped, err := sendBroadcastBatch(context.Background(), broadcast.ID)
+	if err != nil || queued != 2 || stopped {
+		_t.Fatalf("Expected the first batch to be queued, got %d %v (%v)", queued, stopped, err)
+	}
+
+	err = pauseBroadcast(context.Background(), broadcast.ID)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	queued, stopped, err = sendBroadcastBatch(context.Background(), broadcast.ID)
+	if err != nil || queued != 0 || !stopped {
+		_t.Fatalf("Expected nothing to be queued while paused, got %d %v (%v)", queued, stopped, err)
+	}
+
+	err = resumeBroadcast(context.Background(), broadcast.ID)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	err = runBroadcast(context.Background(), broadcast.ID, nil)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	rows, err := pool.Query(context.Background(), `SELECT recipient, COUNT(*) FROM mail WHERE broadcast_id = $1 GROUP BY recipient`, broadcast.ID)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	sent := map[string]int{}
+	for rows.Next() {
+		var recipient string
+		var count int
+		err = rows.Scan(&recipient, &count)
+		if err != nil {
+			_t.Fatal(err)
+		}
+
+		sent[recipient] = count
+	}
+
+	if rows.Err() != nil {
+		_t.Fatal(rows.Err())
+	}
+
+	for _, mlid := range mlids {
+		if sent[mlid] != 1 {
+			_t.Errorf("Expected %s to be sent the broadcast once, it was sent it %d times", mlid, sent[mlid])
+		}
+	}
+
+	// Broadcast mail has no data of its own, so its size comes from the broadcast.
+	var account AdminAccount
+	err = pool.QueryRow(context.Background(), QueryAccount, mlids[0]).Scan(&account.Mlid, &account.ContactPolicy, &account.QueuedMail, &account.QueuedBytes, &account.SentMail, &account.SentBytes)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	if account.QueuedMail != 1 || account.QueuedBytes == 0 {
+		_t.Errorf("Expected one queued message with a size, got %d of %d bytes", account.QueuedMail, account.QueuedBytes)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CGICode is the cd value of a CGI response. The console shows the code alongside an error,
+// so each one has to mean the same thing everywhere.
+type CGICode int
+
+// Codes the server has always sent, which consoles have been seeing since it was first run.
+const (
+	CGICodeSuccess               CGICode = 100
+	CGICodeDuplicateRegistration CGICode = 211
+	CGICodeInvalidCredentials    CGICode = 250
+	CGICodeCheckFailed           CGICode = 320
+	CGICodeUnknownMlchkid        CGICode = 321
+	CGICodeInvalidMaxSize        CGICode = 330
+	CGICodeInvalidDelNum         CGICode = 340
+	CGICodeInvalidMail           CGICode = 350
+	CGICodeTooManyMessages       CGICode = 351
+	CGICodeRegistrationFailed    CGICode = 410
+	CGICodeStorageFailed         CGICode = 450
+	CGICodeDeleteFailed          CGICode = 541
+	CGICodeServerError           CGICode = 551
+	CGICodeInvalidMlid           CGICode = 610
+)
+
+// Server-defined codes, added for features the original server did not have. They were chosen to sit next to
+// related codes, but nothing is known about how the console treats them beyond showing them as an error.
+const (
+	CGICodeSuspendedMlid      CGICode = 251
+	CGICodeSuspendedHollywood CGICode = 252
+	CGICodeSuspendedIP        CGICode = 253
+	CGICodeInvalidMethod      CGICode = 300
+	CGICodeUnknownAction      CGICode = 301
+	CGICodeInvalidParameter   CGICode = 360
+)
+
+// serverDefinedCodes are the codes in the second group above.
+var serverDefinedCodes = map[CGICode]bool{
+	CGICodeSuspendedMlid:      true,
+	CGICodeSuspendedHollywood: true,
+	CGICodeSuspendedIP:        true,
+	CGICodeInvalidMethod:      true,
+	CGICodeUnknownAction:      true,
+	CGICodeInvalidParameter:   true,
+}
+
+// cgiCodeMeanings describes why the server sends each code, for logs and support. The console never sees these.
+var cgiCodeMeanings = map[CGICode]string{
+	CGICodeSuccess:               "request succeeded",
+	CGICodeDuplicateRegistration: "Wii number is already registered",
+	CGICodeInvalidCredentials:    "mlid or password is wrong",
+	CGICodeSuspendedMlid:         "Wii number is suspended",
+	CGICodeSuspendedHollywood:    "console is suspended",
+	CGICodeSuspendedIP:           "network is suspended",
+	CGICodeInvalidMethod:         "request was not a POST",
+	CGICodeUnknownAction:         "no such CGI",
+	CGICodeCheckFailed:           "mail check could not be completed",
+	CGICodeUnknownMlchkid:        "mlchkid does not belong to an account",
+	CGICodeInvalidMaxSize:        "maxsize is not a number",
+	CGICodeInvalidDelNum:         "delnum is not a number",
+	CGICodeInvalidMail:           "message impersonates another user or is not allowed from its title",
+	CGICodeTooManyMessages:       "more than 16 messages in one request",
+	CGICodeInvalidParameter:      "a request parameter or message is missing or malformed",
+	CGICodeRegistrationFailed:    "account could not be registered",
+	CGICodeStorageFailed:         "message could not be stored",
+	CGICodeDeleteFailed:          "mail or account could not be deleted",
+	CGICodeServerError:           "server error, the console should try again later",
+	CGICodeInvalidMlid:           "mlid is missing or not a valid Wii number",
+}
+
+// ServerDefined reports whether the code was added by this server rather than being one it has always sent.
+func (c CGICode) ServerDefined() bool {
+	return serverDefinedCodes[c]
+}
+
+func (c CGICode) String() string {
+	if meaning, ok := cgiCodeMeanings[c]; ok {
+		if c.ServerDefined() {
+			return fmt.Sprintf("%d (%s, server-defined)", int(c), meaning)
+		}
+
+		return fmt.Sprintf("%d (%s)", int(c), meaning)
+	}
+
+	return strconv.Itoa(int(c))
+}
+
+func GenCGIError(code CGICode, message string) CGIResponse {
+	return CGIResponse{
+		code:    code,
+		message: message,
+	}
+}
+
+// GenCGISuccess returns a successful response, to which the action's values are added.
+func GenCGISuccess() CGIResponse {
+	return GenCGIError(CGICodeSuccess, "Success.")
+}
+
+// validCGIKey reports whether a key is safe to write: ASCII letters, digits, dots and underscores.
+func validCGIKey(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// Add appends a key/value pair to the response. A key that is not safe to write is reported and left out.
+func (c *CGIResponse) Add(key, value string) *CGIResponse {
+	if !validCGIKey(key) {
+		ReportErrorGlobal(fmt.Errorf("invalid CGI key %q", key))
+		return c
+	}
+
+	c.other = append(c.other, KV{key: key, value: value})
+	return c
+}
+
+// AddMailResponse adds the result for one of the messages in a send.cgi request, index being its form key such as m1.
+func (c *CGIResponse) AddMailResponse(index string, code CGICode, message string) {
+	c.Add("cd"+index[1:], strconv.Itoa(int(code)))
+	c.Add("msg"+index[1:], message)
+}
+
+// escapeCGIValue keeps a value on its own line. Backslashes and control characters are escaped,
+// so a line break in an error message cannot start a new key.
+func escapeCGIValue(value string) string {
+	var escaped strings.Builder
+	for _, c := range value {
+		switch {
+		case c == '\\':
+			escaped.WriteString(`\\`)
+		case c == '\n':
+			escaped.WriteString(`\n`)
+		case c == '\r':
+			escaped.WriteString(`\r`)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&escaped, `\x%02x`, c)
+		default:
+			escaped.WriteRune(c)
+		}
+	}
+
+	return escaped.String()
+}
+
+func ConvertToCGI(response CGIResponse) string {
+	var work strings.Builder
+	if response.code != 0 {
+		work.WriteString("cd=")
+		work.WriteString(strconv.Itoa(int(response.code)))
+		work.WriteByte('\n')
+	}
+
+	if response.message != "" {
+		work.WriteString("msg=")
+		work.WriteString(escapeCGIValue(response.message))
+		work.WriteByte('\n')
+	}
+
+	for _, kv := range response.other {
+		if !validCGIKey(kv.key) {
+			ReportErrorGlobal(fmt.Errorf("dropped invalid CGI key %q", kv.key))
+			continue
+		}
+
+		work.WriteString(kv.key)
+		work.WriteByte('=')
+		work.WriteString(escapeCGIValue(kv.value))
+		work.WriteByte('\n')
+	}
+
+	return work.String()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata/golden")
+
+func TestConvertToCGI(_t *testing.T) {
+	cgi := GenCGIError(CGICodeInvalidMail, "line one\r\nkey=injected\\")
+	cgi.Add("mail.flag", "a\x00b")
+	expected := "cd=350\nmsg=line one\\r\\nkey=injected\\\\\nmail.flag=a\\x00b\n"
+	if got := ConvertToCGI(cgi); got != expected {
+		_t.Errorf("Incorrect CGI response.\n\n Expected: '%s'\n\n Got: '%s'", expected, got)
+	}
+
+	// Keys that bypass Add are dropped rather than written.
+	cgi = GenCGISuccess()
+	cgi.other = append(cgi.other, KV{key: "bad\nkey", value: "value"})
+	if got := ConvertToCGI(cgi); got != "cd=100\nmsg=Success.\n" {
+		_t.Errorf("Expected the invalid key to be dropped, got '%s'", got)
+	}
+}
+
+func TestCGIKeys(_t *testing.T) {
+	for _, key := range []string{"cd", "mail.flag", "contact12", "msg_1"} {
+		if !validCGIKey(key) {
+			_t.Errorf("Expected %q to be a valid key", key)
+		}
+	}
+
+	for _, key := range []string{"", "a=b", "a b", "a\nb", "mlid\r"} {
+		if validCGIKey(key) {
+			_t.Errorf("Expected %q to be an invalid key", key)
+		}
+	}
+
+	cgi := GenCGISuccess()
+	cgi.Add("a=b", "c")
+	cgi.Add("mlid", "1")
+	if got := ConvertToCGI(cgi); strings.Contains(got, "a=b") || !strings.Contains(got, "mlid=1") {
+		_t.Errorf("Expected the invalid key to be left out, got %q", got)
+	}
+}
+
+func TestCGICodeString(_t *testing.T) {
+	if got := CGICodeUnknownMlchkid.String(); got != "321 (mlchkid does not belong to an account)" {
+		_t.Errorf("Incorrect description '%s'", got)
+	}
+
+	if got := CGICodeSuspendedIP.String(); got != "253 (network is suspended, server-defined)" {
+		_t.Errorf("Incorrect description '%s'", got)
+	}
+
+	if got := CGICode(999).String(); got != "999" {
+		_t.Errorf("Incorrect description '%s'", got)
+	}
+}
+
+// TestGoldenCGI checks the exact output of each CGI against testdata/golden. Run with -update after an intended change.
+func TestGoldenCGI(_t *testing.T) {
+	config = &Config{}
+	previousCache, previousLimiter := checkCache, authLimiter
+	defer func() {
+		config = nil
+		checkCache, authLimiter = previousCache, previousLimiter
+	}()
+
+	// check.cgi is answered from the cache, so its success path can be tested without a database.
+	checkCache = NewCheckCache()
+	checkCache.Put(hashMlchkid("0123456789abcdef0123456789abcdef"), CheckState{Mlid: "1234567890123456", OldestMail: 1234567890, NewestMail: 1234567890}, checkCache.Now())
+	checkCache.PutNotBanned("1234567890123456", "192.0.2.1")
+	checkCache.Put(hashMlchkid("fedcba9876543210fedcba9876543210"), CheckState{Mlid: "6543210987654321"}, checkCache.Now())
+	checkCache.PutNotBanned("6543210987654321", "192.0.2.1")
+
+	route := newCGIRoute()
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	g.Any("/:service/:action", route.Handle())
+
+	badLogin := url.Values{"mlid": {"w0000000000000000"}, "passwd": {"wrong"}}
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		form   url.Values
+	}{
+		{"check_success", http.MethodPost, "/cgi-bin/check.cgi", url.Values{"mlchkid": {"0123456789abcdef0123456789abcdef"}, "chlng": {"1234567890"}}},
+		{"check_no_mail", http.MethodPost, "/cgi-bin/check.cgi", url.Values{"mlchkid": {"fedcba9876543210fedcba9876543210"}, "chlng": {"1234567890"}}},
+		{"check_missing_mlchkid", http.MethodPost, "/cgi-bin/check.cgi", url.Values{"chlng": {"1234567890"}}},
+		{"check_missing_chlng", http.MethodPost, "/cgi-bin/check.cgi", url.Values{"mlchkid": {"0123456789abcdef0123456789abcdef"}}},
+		{"account_missing_mlid", http.MethodPost, "/cgi-bin/account.cgi", url.Values{}},
+		{"account_invalid_mlid", http.MethodPost, "/cgi-bin/account.cgi", url.Values{"mlid": {"w1234"}}},
+		{"send_invalid_credentials", http.MethodPost, "/cgi-bin/send.cgi", badLogin},
+		{"receive_invalid_credentials", http.MethodPost, "/cgi-bin/receive.cgi", badLogin},
+		{"delete_invalid_credentials", http.MethodPost, "/cgi-bin/delete.cgi", badLogin},
+		{"contacts_invalid_credentials", http.MethodPost, "/cgi-bin/contacts.cgi", badLogin},
+		{"export_invalid_credentials", http.MethodPost, "/cgi-bin/export.cgi", badLogin},
+		{"deleteaccount_invalid_credentials", http.MethodPost, "/cgi-bin/deleteaccount.cgi", badLogin},
+		{"invalid_method", http.MethodGet, "/cgi-bin/check.cgi", nil},
+		{"unknown_action", http.MethodPost, "/cgi-bin/unknown.cgi", url.Values{}},
+	}
+
+	for _, tc := range cases {
+		// Failed logins would otherwise be delayed by the earlier cases.
+		authLimiter = NewAuthLimiter()
+
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.form != nil {
+			req = httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+
+		compareGolden(_t, tc.name, w.Body.String())
+	}
+
+	// The credentials given out by account.cgi need a database to generate, so only the response is checked.
+	cgi := credentialsResponse("w1234567890123456", Credentials{Password: "abcdefghijklmnop", Mlchkid: "0123456789abcdef0123456789abcdef"})
+	compareGolden(_t, "account_success", ConvertToCGI(cgi))
+}
+
+// TestGoldenCGIDatabase checks the responses consoles parse on success, which need a database.
+// A message is sent from one test account to another, received and then deleted.
+func TestGoldenCGIDatabase(_t *testing.T) {
+	config = &Config{}
+	previousCache, previousLimiter := checkCache, authLimiter
+	defer func() {
+		config = nil
+		checkCache, authLimiter = previousCache, previousLimiter
+	}()
+	testDatabase(_t)
+	checkCache, authLimiter = NewCheckCache(), NewAuthLimiter()
+
+	sender, recipient := "1000000000000016", "1000000000000017"
+	passwd := createTestAccounts(_t, sender, recipient)
+
+	g := newTestCGIServer()
+	compareGolden(_t, "send_success", sendFixture(_t, g, "wii_to_wii.txt", sender, recipient, passwd))
+
+	login := url.Values{"mlid": {"w" + recipient}, "passwd": {passwd}}
+	cases := []struct {
+		name string
+		path string
+		form url.Values
+	}{
+		{"receive_success", "/cgi-bin/receive.cgi", url.Values{"maxsize": {"100000"}}},
+		{"delete_success", "/cgi-bin/delete.cgi", url.Values{"delnum": {"1"}}},
+		{"receive_empty", "/cgi-bin/receive.cgi", url.Values{"maxsize": {"100000"}}},
+	}
+
+	for _, tc := range cases {
+		form := url.Values{}
+		for key, value := range login {
+			form[key] = value
+		}
+		for key, value := range tc.form {
+			form[key] = value
+		}
+
+		req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+
+		// The boundary has the time and a random number in it.
+		got := w.Body.String()
+		_, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err == nil && params["boundary"] != "" {
+			got = strings.ReplaceAll(got, params["boundary"], "BOUNDARY")
+		}
+
+		compareGolden(_t, tc.name, got)
+	}
+}
+
+// createTestAccounts replaces any accounts with these mlids, and their mail and quarantined mail, with new ones.
+// They all have the same passwd, which is returned.
+func createTestAccounts(_t *testing.T, mlids ...string) string {
+	passwd := "abcdefghijklmnop"
+	for _, mlid := range mlids {
+		_, err := pool.Exec(context.Background(), `DELETE FROM mail WHERE sender = $1 OR recipient = $1`, mlid)
+		if err != nil {
+			_t.Fatal(err)
+		}
+
+		_, err = pool.Exec(context.Background(), DeleteAccountQuarantine, mlid)
+		if err != nil {
+			_t.Fatal(err)
+		}
+
+		_, err = pool.Exec(context.Background(), `DELETE FROM accounts WHERE mlid = $1`, mlid)
+		if err != nil {
+			_t.Fatal(err)
+		}
+
+		_, err = pool.Exec(context.Background(), CreateAccount, mlid, hashPasswd(passwd), hashMlchkid(mlid), nil)
+		if err != nil {
+			_t.Fatal(err)
+		}
+	}
+
+	return passwd
+}
+
+func compareGolden(_t *testing.T, name, got string) {
+	path := filepath.Join("testdata", "golden", name+".txt")
+	if *updateGolden {
+		err := os.WriteFile(path, []byte(got), 0o644)
+		if err != nil {
+			_t.Fatal(err)
+		}
+	}
+
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	if got != string(expected) {
+		_t.Errorf("Incorrect response for %s.\n\n Expected: '%s'\n\n Got: '%s'", name, expected, got)
+	}
+}
@@ -3,19 +3,30 @@ package main
 import (
 	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha512"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/gin-gonic/gin"
-	"github.com/jackc/pgx/v5"
-	"net/http"
+	"github.com/WiiLink24/Mail-Server/secrets"
+	"strconv"
+	"time"
 )
 
 const (
+	// $1 is the mlchkid hashed with the current scheme, $2 with the original unsalted SHA-512.
+	// $3 is the earliest snowflake sent mail makes the account active from.
 	CheckUserAndMail = `
-		SELECT 
-			COALESCE((SELECT mlid FROM accounts WHERE mlchkid = $1), ''),
-			EXISTS(SELECT 1 FROM mail WHERE recipient = (SELECT mlid FROM accounts WHERE mlchkid = $1) AND is_sent = false)
+		WITH account AS (SELECT mlid, mlchkid, check_interval FROM accounts WHERE mlchkid = $1 OR mlchkid = $2 LIMIT 1)
+		SELECT
+			account.mlid,
+			account.mlchkid <> $1,
+			COALESCE(queue.oldest, 0),
+			COALESCE(queue.newest, 0),
+			COALESCE(account.check_interval, 0),
+			EXISTS(SELECT 1 FROM mail WHERE sender = account.mlid AND snowflake >= $3)
+		FROM account, LATERAL (
+			SELECT MIN(snowflake) AS oldest, MAX(snowflake) AS newest FROM mail WHERE recipient = account.mlid AND is_sent = false
+		) queue
 	`
 	NoMailFlag = "000000000000000000000000000000000"
 )
@@ -23,50 +34,81 @@ const (
 // MailHMACKey is the key used to sign the HMAC.
 var MailHMACKey = []byte{0xce, 0x4c, 0xf2, 0x9a, 0x3d, 0x6b, 0xe1, 0xc2, 0x61, 0x91, 0x72, 0xb5, 0xcb, 0x29, 0x8c, 0x89, 0x72, 0xd4, 0x50, 0xad}
 
-func check(c *gin.Context) {
-	c.Header("X-Wii-Mail-Download-Span", "10")
-	c.Header("X-Wii-Mail-Check-Span", "10")
-	c.Header("X-Wii-Download-Span", "10")
-	c.Header("Content-Type", "text/plain;charset=utf-8")
+// setIntervalHeaders tells the console how many minutes to wait before its next check and download.
+func setIntervalHeaders(r *Response, interval string) {
+	r.Header("X-Wii-Mail-Download-Span", interval)
+	r.Header("X-Wii-Mail-Check-Span", interval)
+	r.Header("X-Wii-Download-Span", interval)
+}
+
+// mailFlagFor returns the flag for an account whose oldest and newest queued mail are oldestMail and newestMail,
+// which are 0 if it has none. The flag we send to the Wii is compared against the flag in wc24send.ctl.
+// If it matches, no new mail is available. If it doesn't, there is mail. Deriving it from the queue means it only
+// changes when the queue does, rather than the Wii downloading again on every check while it has mail waiting.
+// receive.cgi sends the oldest mail first and stops at 10 messages or maxsize, so the oldest changes after every
+// partial download and the Wii comes back for the rest, while the newest changes when new mail arrives.
+func mailFlagFor(mlid string, oldestMail, newestMail int64) string {
+	if newestMail == 0 {
+		return NoMailFlag
+	}
+
+	hash := sha512.Sum512([]byte(fmt.Sprintf("w%s:%d:%d", mlid, oldestMail, newestMail)))
+	flag := make([]byte, len(NoMailFlag))
+	for i := range flag {
+		flag[i] = secrets.Letters[int(hash[i])%len(secrets.Letters)]
+	}
+
+	return string(flag)
+}
+
+func check(r *Response) {
+	now := time.Now()
+	rate := checkLoad.Add(now)
+	setIntervalHeaders(r, strconv.Itoa(checkInterval(0, false, rate)))
 
-	mlchkid := c.PostForm("mlchkid")
+	mlchkid := r.PostForm("mlchkid")
 	if mlchkid == "" {
-		cgi := GenCGIError(320, "Unable to find mlchkid.")
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeCheckFailed, "Unable to find mlchkid.")
+		r.WriteCGI(cgi)
 		return
 	}
 
-	challenge := c.PostForm("chlng")
+	challenge := r.PostForm("chlng")
 	if challenge == "" {
-		cgi := GenCGIError(320, "Unable to find chlng.")
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeCheckFailed, "Unable to find chlng.")
+		r.WriteCGI(cgi)
 		return
 	}
 
-	var mlid string
-	var hasMail bool
-
-	password := hashPassword(mlchkid)
-	row := pool.QueryRow(c.Copy(), CheckUserAndMail, password)
-	err := row.Scan(&mlid, &hasMail)
-	if errors.Is(err, pgx.ErrNoRows) || mlid == "" {
-		cgi := GenCGIError(321, "User does not exist.")
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+	state, err := lookupCheckState(r.Context(), mlchkid, now)
+	if errors.Is(err, ErrAccountNotFound) {
+		cgi := GenCGIError(CGICodeUnknownMlchkid, "User does not exist.")
+		r.WriteCGI(cgi)
 		return
 	} else if err != nil {
-		cgi := GenCGIError(320, "Error has occurred in check query.")
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeCheckFailed, "Error has occurred in check query.")
+		r.WriteCGI(cgi)
 		return
 	}
 
-	// The flag we send to the Wii is compared against the flag in wc24send.ctl. If it matches, no new mail is available.
-	// If it doesn't, there is mail.
-	mailFlag := NoMailFlag
-	if hasMail {
-		// Update mail flag
-		mailFlag = RandStringBytesMaskImprSrc(33)
+	mlid := state.Mlid
+	err = cachedCheckBans(r.Context(), mlid, r.ClientIP())
+	if cgi, banned := banResponse(err); banned {
+		r.WriteCGI(cgi)
+		return
+	} else if err != nil {
+		cgi := GenCGIError(CGICodeCheckFailed, "Error has occurred in check query.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
+		return
 	}
 
+	mailFlag := mailFlagFor(mlid, state.OldestMail, state.NewestMail)
+
+	// The interval is signed along with the flag, so the one in the headers has to be the same.
+	interval := strconv.Itoa(checkInterval(state.AccountInterval, state.Active, rate))
+	setIntervalHeaders(r, interval)
+
 	h := hmac.New(sha1.New, MailHMACKey)
 	h.Write([]byte(challenge))
 	h.Write([]byte("\n"))
@@ -75,33 +117,19 @@ func check(c *gin.Context) {
 	h.Write([]byte("\n"))
 	h.Write([]byte(mailFlag))
 	h.Write([]byte("\n"))
-	h.Write([]byte("10"))
-
-	cgi := CGIResponse{
-		code:    100,
-		message: "Success.",
-		other: []KV{
-			{
-				key:   "res",
-				value: hex.EncodeToString(h.Sum(nil)),
-			},
-			{
-				key:   "mail.flag",
-				value: mailFlag,
-			},
-			{
-				key:   "interval",
-				value: "10",
-			},
-		},
-	}
+	h.Write([]byte(interval))
+
+	cgi := GenCGISuccess()
+	cgi.Add("res", hex.EncodeToString(h.Sum(nil)))
+	cgi.Add("mail.flag", mailFlag)
+	cgi.Add("interval", interval)
 
 	if config.UseDatadog {
 		err = dataDog.Incr("mail.checked", nil, 1)
 		if err != nil {
-			ReportErrorGin(c, err)
+			r.ReportError(err)
 		}
 	}
 
-	c.String(http.StatusOK, ConvertToCGI(cgi))
+	r.WriteCGI(cgi)
 }
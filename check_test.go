@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/WiiLink24/Mail-Server/secrets"
+)
+
+func TestMailFlagFor(_t *testing.T) {
+	if flag := mailFlagFor("1234567890123456", 0, 0); flag != NoMailFlag {
+		_t.Errorf("Incorrect flag without mail.\n\n Expected: '%s'\n\n Got: '%s'", NoMailFlag, flag)
+	}
+
+	flag := mailFlagFor("1234567890123456", 1000, 1000)
+	if len(flag) != len(NoMailFlag) || strings.Trim(flag, secrets.Letters) != "" {
+		_t.Errorf("Invalid flag '%s'", flag)
+	}
+
+	if mailFlagFor("1234567890123456", 1000, 1000) != flag {
+		_t.Errorf("The flag changed without new mail")
+	}
+
+	if mailFlagFor("1234567890123456", 1000, 1001) == flag || mailFlagFor("6543210987654321", 1000, 1000) == flag {
+		_t.Errorf("The flag did not change with new mail or another account")
+	}
+}
+
+// TestMailFlagPartialReceive follows a queue of 15 messages, which receive.cgi sends 10 at a time.
+func TestMailFlagPartialReceive(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	cache := NewCheckCache()
+	mlid := "1234567890123456"
+	cache.Put("hash", CheckState{Mlid: mlid}, cache.Now())
+
+	for snowflake := int64(1); snowflake <= 15; snowflake++ {
+		cache.MailQueued(mlid, snowflake)
+	}
+
+	state, _ := cache.Get("hash")
+	full := mailFlagFor(mlid, state.OldestMail, state.NewestMail)
+
+	// The oldest 10 are received, leaving the newest 5 queued.
+	cache.ForgetMailbox(mlid)
+	cache.Put("hash", CheckState{Mlid: mlid, OldestMail: 11, NewestMail: 15}, cache.Now().Add(time.Nanosecond))
+	state, _ = cache.Get("hash")
+	partial := mailFlagFor(mlid, state.OldestMail, state.NewestMail)
+	if partial == full || partial == NoMailFlag {
+		_t.Errorf("Expected the flag to change after a partial download, so the Wii comes back for the rest")
+	}
+
+	cache.ForgetMailbox(mlid)
+	cache.Put("hash", CheckState{Mlid: mlid}, cache.Now().Add(time.Nanosecond))
+	state, _ = cache.Get("hash")
+	if flag := mailFlagFor(mlid, state.OldestMail, state.NewestMail); flag != NoMailFlag {
+		_t.Errorf("Expected no mail once the queue is empty, got '%s'", flag)
+	}
+}
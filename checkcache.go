@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	DefaultCheckCacheSeconds = 300
+	// checkCacheSweepSize is how many entries a map holds before expired ones are removed.
+	checkCacheSweepSize = 100000
+	// checkCacheChangeWindow is how long changes are remembered for, which is longer than any check query takes.
+	checkCacheChangeWindow = time.Minute
+)
+
+// CheckState is everything check.cgi needs to know about an account.
+type CheckState struct {
+	Mlid            string
+	OldestMail      int64
+	NewestMail      int64
+	AccountInterval int
+	Active          bool
+}
+
+type cachedAccount struct {
+	mlid     string
+	interval int
+	expires  time.Time
+}
+
+// changedRange is when a broadcast batch queued mail for some of the mailboxes from first to last.
+type changedRange struct {
+	first string
+	last  string
+	at    time.Time
+}
+
+type cachedMailbox struct {
+	oldestMail int64
+	newestMail int64
+	active     bool
+	expires    time.Time
+}
+
+// CheckCache lets most check.cgi requests be answered without Postgres. It maps mlchkid hashes to accounts,
+// and keeps the oldest and newest queued mail for each account, which is updated as mail is queued and cleared
+// as it is received or deleted. Entries expire after the TTL, which bounds how stale they can be when
+// another server changes the database.
+type CheckCache struct {
+	mu        sync.Mutex
+	accounts  map[string]cachedAccount
+	hashes    map[string]string
+	mailboxes map[string]cachedMailbox
+	// changed is when each mailbox last changed, so state loaded before then is not cached.
+	// changedRanges is the same for broadcast batches, oldest first.
+	changed       map[string]time.Time
+	changedRanges []changedRange
+	bans          map[string]time.Time
+	now           func() time.Time
+}
+
+var checkCache = NewCheckCache()
+
+func NewCheckCache() *CheckCache {
+	return &CheckCache{
+		accounts:  map[string]cachedAccount{},
+		hashes:    map[string]string{},
+		mailboxes: map[string]cachedMailbox{},
+		changed:   map[string]time.Time{},
+		bans:      map[string]time.Time{},
+		now:       time.Now,
+	}
+}
+
+func checkCacheTTL() time.Duration {
+	if config.CheckCacheSeconds < 0 {
+		return 0
+	}
+
+	return time.Duration(intervalSetting(config.CheckCacheSeconds, DefaultCheckCacheSeconds)) * time.Second
+}
+
+// Get returns the cached state for an mlchkid hash, if both the account and its mailbox are cached.
+func (c *CheckCache) Get(mlchkidHash string) (CheckState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	account, ok := c.accounts[mlchkidHash]
+	if !ok || now.After(account.expires) {
+		return CheckState{}, false
+	}
+
+	mailbox, ok := c.mailboxes[account.mlid]
+	if !ok || now.After(mailbox.expires) {
+		return CheckState{}, false
+	}
+
+	return CheckState{
+		Mlid:            account.mlid,
+		OldestMail:      mailbox.oldestMail,
+		NewestMail:      mailbox.newestMail,
+		AccountInterval: account.interval,
+		Active:          mailbox.active,
+	}, true
+}
+
+// Now returns the time to pass to Put for state about to be loaded.
+func (c *CheckCache) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now()
+}
+
+// Put caches the state loaded from the database for an mlchkid hash at loadedAt.
+// Nothing is cached if the account changed since then, as the state may already be stale.
+func (c *CheckCache) Put(mlchkidHash string, state CheckState, loadedAt time.Time) {
+	ttl := checkCacheTTL()
+	if ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.pruneChangedRanges(now)
+	if c.changedSince(state.Mlid, loadedAt) {
+		return
+	}
+
+	if len(c.accounts) > checkCacheSweepSize || len(c.changed) > checkCacheSweepSize {
+		c.sweep(now)
+	}
+
+	if previous, ok := c.hashes[state.Mlid]; ok && previous != mlchkidHash {
+		delete(c.accounts, previous)
+	}
+
+	c.accounts[mlchkidHash] = cachedAccount{mlid: state.Mlid, interval: state.AccountInterval, expires: now.Add(ttl)}
+	c.hashes[state.Mlid] = mlchkidHash
+	c.mailboxes[state.Mlid] = cachedMailbox{oldestMail: state.OldestMail, newestMail: state.NewestMail, active: state.Active, expires: now.Add(ttl)}
+}
+
+// changedSince reports whether a mailbox has changed at or after t.
+func (c *CheckCache) changedSince(mlid string, t time.Time) bool {
+	if changed, ok := c.changed[mlid]; ok && !changed.Before(t) {
+		return true
+	}
+
+	for _, r := range c.changedRanges {
+		if mlid >= r.first && mlid <= r.last && !r.at.Before(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *CheckCache) sweep(now time.Time) {
+	for hash, account := range c.accounts {
+		if now.After(account.expires) {
+			delete(c.accounts, hash)
+			delete(c.hashes, account.mlid)
+		}
+	}
+
+	for mlid, mailbox := range c.mailboxes {
+		if now.After(mailbox.expires) {
+			delete(c.mailboxes, mlid)
+		}
+	}
+
+	for mlid, changed := range c.changed {
+		if now.Sub(changed) > checkCacheChangeWindow {
+			delete(c.changed, mlid)
+		}
+	}
+
+	c.sweepBans(now)
+}
+
+func (c *CheckCache) sweepBans(now time.Time) {
+	for key, expires := range c.bans {
+		if now.After(expires) {
+			delete(c.bans, key)
+		}
+	}
+}
+
+// MailQueued records new mail for a cached mailbox. Mailboxes that are not cached are loaded on their next check.
+func (c *CheckCache) MailQueued(mlid string, snowflake int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.changed[mlid] = c.now()
+	mailbox, ok := c.mailboxes[mlid]
+	if !ok {
+		return
+	}
+
+	// Servers hear about their own mail twice, from the code that queued it and from its notification,
+	// so this must not change anything the second time.
+	if mailbox.oldestMail == 0 || snowflake < mailbox.oldestMail {
+		mailbox.oldestMail = snowflake
+	}
+
+	mailbox.newestMail = max(mailbox.newestMail, snowflake)
+	c.mailboxes[mlid] = mailbox
+}
+
+// MailSent marks a cached mailbox as active after its account sends mail.
+func (c *CheckCache) MailSent(mlid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.changed[mlid] = c.now()
+	if mailbox, ok := c.mailboxes[mlid]; ok {
+		mailbox.active = true
+		c.mailboxes[mlid] = mailbox
+	}
+}
+
+// ForgetMailbox drops a mailbox whose queue has changed in a way that can only be known from the database,
+// such as mail being received or deleted.
+func (c *CheckCache) ForgetMailbox(mlid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.changed[mlid] = c.now()
+	delete(c.mailboxes, mlid)
+}
+
+// ForgetMailboxes drops every mailbox from first to last in mlid order, after a broadcast batch queued mail
+// for some of them. Broadcast events do not say which, as a batch can be thousands of accounts.
+func (c *CheckCache) ForgetMailboxes(first, last string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for mlid := range c.mailboxes {
+		if mlid >= first && mlid <= last {
+			delete(c.mailboxes, mlid)
+		}
+	}
+
+	c.pruneChangedRanges(now)
+	c.changedRanges = append(c.changedRanges, changedRange{first: first, last: last, at: now})
+}
+
+// pruneChangedRanges removes broadcast batches older than the change window.
+func (c *CheckCache) pruneChangedRanges(now time.Time) {
+	expired := 0
+	for expired < len(c.changedRanges) && now.Sub(c.changedRanges[expired].at) > checkCacheChangeWindow {
+		expired++
+	}
+
+	c.changedRanges = c.changedRanges[expired:]
+}
+
+// ForgetAccount drops everything cached for an account, after its credentials or settings change.
+// Other servers are told by the account_notify trigger when MailEvents are enabled.
+func (c *CheckCache) ForgetAccount(mlid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.changed[mlid] = c.now()
+	delete(c.accounts, c.hashes[mlid])
+	delete(c.hashes, mlid)
+	delete(c.mailboxes, mlid)
+}
+
+// NotBanned reports whether the mlid and IP were recently checked and found not to be suspended.
+func (c *CheckCache) NotBanned(mlid, ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires, ok := c.bans[mlid+"|"+ip]
+	return ok && c.now().Before(expires)
+}
+
+func (c *CheckCache) PutNotBanned(mlid, ip string) {
+	ttl := checkCacheTTL()
+	if ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Every IP a console checks from has its own entry, so the bans are swept on their own size.
+	now := c.now()
+	if len(c.bans) > checkCacheSweepSize {
+		c.sweepBans(now)
+	}
+
+	c.bans[mlid+"|"+ip] = now.Add(ttl)
+}
+
+// ForgetBans is called when a ban is added, so it applies straight away. Other servers are told by the bans_notify
+// trigger when MailEvents are enabled.
+func (c *CheckCache) ForgetBans() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.bans = map[string]time.Time{}
+}
+
+// lookupCheckState returns the state of the account an mlchkid belongs to, from the cache if possible.
+// Accounts still using the original mlchkid hash are upgraded. ErrAccountNotFound is returned for unknown mlchkids.
+func lookupCheckState(ctx context.Context, mlchkid string, now time.Time) (CheckState, error) {
+	mlchkidHash := hashMlchkid(mlchkid)
+	if state, ok := checkCache.Get(mlchkidHash); ok {
+		return state, nil
+	}
+
+	var state CheckState
+	var needsRehash bool
+	loadedAt := checkCache.Now()
+	legacyHash := hashPassword(mlchkid)
+	row := pool.QueryRow(ctx, CheckUserAndMail, mlchkidHash, legacyHash, snowflakeAt(activeSince(now)))
+	err := row.Scan(&state.Mlid, &needsRehash, &state.OldestMail, &state.NewestMail, &state.AccountInterval, &state.Active)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && state.Mlid == "") {
+		return CheckState{}, ErrAccountNotFound
+	} else if err != nil {
+		return CheckState{}, err
+	}
+
+	if needsRehash {
+		_, err = pool.Exec(ctx, UpdateMlchkidHash, state.Mlid, legacyHash, mlchkidHash)
+		if err != nil {
+			// The console can still be answered, and the upgrade will be tried again next time.
+			ReportErrorGlobal(err)
+			return state, nil
+		}
+	}
+
+	checkCache.Put(mlchkidHash, state, loadedAt)
+	return state, nil
+}
+
+// cachedCheckBans is checkBans for check.cgi, which skips the database for mlids and IPs recently found not to be suspended.
+func cachedCheckBans(ctx context.Context, mlid, ip string) error {
+	if checkCache.NotBanned(mlid, ip) {
+		return nil
+	}
+
+	err := checkBans(ctx, mlid, ip)
+	if err == nil {
+		checkCache.PutNotBanned(mlid, ip)
+	}
+
+	return err
+}
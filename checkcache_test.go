@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestCheckCache(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewCheckCache()
+	cache.now = func() time.Time { return now }
+
+	state := CheckState{Mlid: "1234567890123456", OldestMail: 10, NewestMail: 10, AccountInterval: 5}
+	cache.Put("hash", state, now)
+	if got, ok := cache.Get("hash"); !ok || got != state {
+		_t.Fatalf("Incorrect cached state.\n\n Expected: '%v'\n\n Got: '%v'", state, got)
+	}
+
+	cache.MailQueued(state.Mlid, 20)
+	cache.MailQueued(state.Mlid, 15)
+	cache.MailQueued(state.Mlid, 20)
+	cache.MailSent(state.Mlid)
+	if got, _ := cache.Get("hash"); got.OldestMail != 10 || got.NewestMail != 20 || !got.Active {
+		_t.Errorf("Expected mail from 10 to 20 and active, got %v", got)
+	}
+
+	cache.ForgetMailbox(state.Mlid)
+	if _, ok := cache.Get("hash"); ok {
+		_t.Errorf("Expected the mailbox to be forgotten")
+	}
+
+	// State loaded before the mailbox changed must not be cached.
+	cache.Put("hash", state, now.Add(-time.Second))
+	if _, ok := cache.Get("hash"); ok {
+		_t.Errorf("Stale state was cached")
+	}
+
+	now = now.Add(time.Second)
+	cache.Put("new hash", state, now)
+	if _, ok := cache.Get("new hash"); !ok {
+		_t.Errorf("Expected state loaded after the change to be cached")
+	}
+
+	if _, ok := cache.Get("hash"); ok {
+		_t.Errorf("Expected the old mlchkid hash to be replaced")
+	}
+
+	now = now.Add(DefaultCheckCacheSeconds*time.Second + time.Second)
+	if _, ok := cache.Get("new hash"); ok {
+		_t.Errorf("Expected the entry to expire")
+	}
+}
+
+func TestCheckCacheBans(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	cache := NewCheckCache()
+	cache.PutNotBanned("1234567890123456", "192.0.2.1")
+	if !cache.NotBanned("1234567890123456", "192.0.2.1") || cache.NotBanned("1234567890123456", "192.0.2.2") {
+		_t.Errorf("Incorrect cached ban result")
+	}
+
+	cache.ForgetBans()
+	if cache.NotBanned("1234567890123456", "192.0.2.1") {
+		_t.Errorf("Expected adding a ban to clear cached results")
+	}
+
+	// Results are swept once they expire, even if no accounts are being cached.
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	for i := 0; i <= checkCacheSweepSize; i++ {
+		cache.PutNotBanned("1234567890123456", fmt.Sprintf("ip%d", i))
+	}
+
+	now = now.Add(DefaultCheckCacheSeconds*time.Second + time.Second)
+	cache.PutNotBanned("1234567890123456", "192.0.2.1")
+	if len(cache.bans) != 1 {
+		_t.Errorf("Expected expired results to be swept, %d are left", len(cache.bans))
+	}
+}
+
+func TestCheckCacheBroadcast(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewCheckCache()
+	cache.now = func() time.Time { return now }
+
+	loaded := now
+	cache.Put("first", CheckState{Mlid: "1000000000000016"}, loaded)
+	cache.Put("second", CheckState{Mlid: "1000000000000017"}, loaded)
+
+	now = now.Add(time.Second)
+	cache.ForgetMailboxes("1000000000000010", "1000000000000016")
+	if _, ok := cache.Get("first"); ok {
+		_t.Errorf("Expected the mailbox in the batch to be forgotten")
+	}
+
+	if _, ok := cache.Get("second"); !ok {
+		_t.Errorf("Expected the mailbox after the batch to be kept")
+	}
+
+	// State loaded before the batch was queued must not be cached.
+	cache.Put("first", CheckState{Mlid: "1000000000000016"}, loaded)
+	if _, ok := cache.Get("first"); ok {
+		_t.Errorf("Stale state was cached")
+	}
+
+	now = now.Add(checkCacheChangeWindow + time.Second)
+	cache.Put("first", CheckState{Mlid: "1000000000000016"}, now)
+	if _, ok := cache.Get("first"); !ok || len(cache.changedRanges) != 0 {
+		_t.Errorf("Expected the batch to be forgotten after the change window")
+	}
+}
+
+func BenchmarkCheckCached(b *testing.B) {
+	config = &Config{MlchkidKey: "benchmark"}
+	defer func() { config = nil }()
+
+	previous := checkCache
+	checkCache = NewCheckCache()
+	defer func() { checkCache = previous }()
+
+	mlchkid := "abcdefghijklmnopqrstuvwxyzABCDEF"
+	checkCache.Put(hashMlchkid(mlchkid), CheckState{Mlid: "1234567890123456"}, time.Now())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := lookupCheckState(context.Background(), mlchkid, time.Now())
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkCheckQuery runs the query every check used to, against the database in MAIL_SERVER_TEST_DATABASE.
+func BenchmarkCheckQuery(b *testing.B) {
+	databaseURL := os.Getenv("MAIL_SERVER_TEST_DATABASE")
+	if databaseURL == "" {
+		b.Skip("MAIL_SERVER_TEST_DATABASE is not set")
+	}
+
+	config = &Config{MlchkidKey: "benchmark"}
+	defer func() { config = nil }()
+
+	db, err := pgxpool.New(context.Background(), databaseURL)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	mlchkid := "abcdefghijklmnopqrstuvwxyzABCDEF"
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var state CheckState
+		var needsRehash bool
+		err = db.QueryRow(context.Background(), CheckUserAndMail, hashMlchkid(mlchkid), hashPassword(mlchkid), snowflakeAt(activeSince(time.Now()))).
+			Scan(&state.Mlid, &needsRehash, &state.OldestMail, &state.NewestMail, &state.AccountInterval, &state.Active)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			b.Fatal(err)
+		}
+	}
+}
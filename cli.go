@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/jackc/pgx/v5"
+)
+
+const PurgeMail = `DELETE FROM mail WHERE recipient = $1 AND ($2 = false OR is_sent = true)`
+
+// commandOutput is where commands print their results.
+var commandOutput io.Writer = os.Stdout
+
+// Command is an operator subcommand of the server binary.
+type Command struct {
+	Name  string
+	Usage string
+	Run   func(args []string) error
+}
+
+var commands = []Command{
+	{"account create", "<mlid>", accountCreateCommand},
+	{"account show", "<mlid>", accountShowCommand},
+	{"account delete", "<mlid>", accountDeleteCommand},
+	{"account export", "<mlid> <file.mbox>", accountExportCommand},
+	{"account token", "[-ttl duration] [-actor name] <mlid>", accountTokenCommand},
+	{"mail list", "[-status queued|sent] <mlid>", mailListCommand},
+	{"mail inject", "<mlid> <file.eml>", mailInjectCommand},
+	{"mail purge", "[-sent] <mlid>", mailPurgeCommand},
+	{"inbound run-once", "", inboundRunOnceCommand},
+	{"config check", "", configCheckCommand},
+	{"ban", "<add|lift|list> ...", runBanCommand},
+	{"community", "<create|list> ...", runCommunityCommand},
+	{"broadcast", "<create|pause|resume|list> ...", runBroadcastCommand},
+}
+
+// runCommand finds the command matching the start of args and runs it with the remaining arguments.
+func runCommand(args []string) error {
+	for _, command := range commands {
+		words := strings.Fields(command.Name)
+		if len(args) >= len(words) && strings.Join(args[:len(words)], " ") == command.Name {
+			return command.Run(args[len(words):])
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "Usage: run without arguments to start the server, or use one of:")
+	for _, command := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", command.Name, command.Usage)
+	}
+	w.Flush()
+
+	return fmt.Errorf("unknown command %s", strings.Join(args, " "))
+}
+
+// parseMlidArg validates an mlid given on the command line, with or without its w, and returns it without.
+func parseMlidArg(arg string) (string, error) {
+	mlid := strings.TrimPrefix(strings.ToLower(arg), "w")
+	if !validateFriendCode(mlid) {
+		return "", fmt.Errorf("%s is not a valid Wii number", arg)
+	}
+
+	return mlid, nil
+}
+
+// singleMlidArg parses args for commands taking flags followed by one mlid.
+func singleMlidArg(flags *flag.FlagSet, args []string, usage string) (string, error) {
+	err := flags.Parse(args)
+	if err != nil {
+		return "", err
+	}
+
+	if flags.NArg() != 1 {
+		return "", fmt.Errorf("usage: %s", usage)
+	}
+
+	return parseMlidArg(flags.Arg(0))
+}
+
+func accountCreateCommand(args []string) error {
+	mlid, err := singleMlidArg(flag.NewFlagSet("account create", flag.ContinueOnError), args, "account create <mlid>")
+	if err != nil {
+		return err
+	}
+
+	credentials := generateCredentials()
+	_, err = pool.Exec(ctx, CreateAccount, mlid, credentials.PasswordHash, credentials.MlchkidHash, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(commandOutput, "mlid=w%s\npasswd=%s\nmlchkid=%s\n", mlid, credentials.Password, credentials.Mlchkid)
+	return nil
+}
+
+func accountShowCommand(args []string) error {
+	mlid, err := singleMlidArg(flag.NewFlagSet("account show", flag.ContinueOnError), args, "account show <mlid>")
+	if err != nil {
+		return err
+	}
+
+	var account AdminAccount
+	err = pool.QueryRow(ctx, QueryAccount, mlid).Scan(&account.Mlid, &account.ContactPolicy, &account.QueuedMail, &account.QueuedBytes, &account.SentMail, &account.SentBytes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrAccountNotFound
+	} else if err != nil {
+		return err
+	}
+
+	printAccount(account)
+	return printActiveBan(mlid)
+}
+
+func printAccount(account AdminAccount) {
+	fmt.Fprintf(commandOutput, "mlid:           w%s\n", account.Mlid)
+	fmt.Fprintf(commandOutput, "contact policy: %s\n", account.ContactPolicy)
+	fmt.Fprintf(commandOutput, "queued mail:    %d (%d bytes)\n", account.QueuedMail, account.QueuedBytes)
+	fmt.Fprintf(commandOutput, "sent mail:      %d (%d bytes)\n", account.SentMail, account.SentBytes)
+}
+
+// printActiveBan prints any active ban on an account.
+func printActiveBan(mlid string) error {
+	err := checkBans(ctx, mlid, "")
+	var banErr *BanError
+	if errors.As(err, &banErr) {
+		fmt.Fprintf(commandOutput, "suspended:      ban %d, %s\n", banErr.Ban.ID, banErr.Error())
+		return nil
+	}
+
+	return err
+}
+
+func accountDeleteCommand(args []string) error {
+	mlid, err := singleMlidArg(flag.NewFlagSet("account delete", flag.ContinueOnError), args, "account delete <mlid>")
+	if err != nil {
+		return err
+	}
+
+	err = deleteAccount(ctx, mlid)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(commandOutput, "Deleted w%s and all of its mail.\n", mlid)
+	return nil
+}
+
+func accountExportCommand(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: account export <mlid> <file.mbox>")
+	}
+
+	mlid, err := parseMlidArg(args[0])
+	if err != nil {
+		return err
+	}
+
+	messages, err := queryExportMail(ctx, mlid)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(args[1])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = writeMbox(file, messages)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(commandOutput, "Exported %d messages for w%s.\n", len(messages), mlid)
+	return file.Close()
+}
+
+// accountTokenCommand issues a one-time token the owner of an mlid can re-register with after losing their nwc24msg.cfg.
+func accountTokenCommand(args []string) error {
+	flags := flag.NewFlagSet("account token", flag.ContinueOnError)
+	ttl := flags.Duration("ttl", DefaultReprovisionTokenTTL, "how long the token can be used for")
+	actor := flags.String("actor", os.Getenv("USER"), "who is issuing the token")
+	mlid, err := singleMlidArg(flags, args, "account token [-ttl duration] [-actor name] <mlid>")
+	if err != nil {
+		return err
+	}
+
+	token, err := issueReprovisionToken(ctx, mlid, *actor, *ttl)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(commandOutput, "token=%s\n", token)
+	return nil
+}
+
+func mailListCommand(args []string) error {
+	flags := flag.NewFlagSet("mail list", flag.ContinueOnError)
+	status := flags.String("status", "", "only list queued or sent mail")
+	mlid, err := singleMlidArg(flags, args, "mail list [-status queued|sent] <mlid>")
+	if err != nil {
+		return err
+	}
+
+	if *status != "" && *status != "queued" && *status != "sent" {
+		return errors.New("status must be queued or sent")
+	}
+
+	rows, err := pool.Query(ctx, QueryAccountMail, mlid, *status)
+	if err != nil {
+		return err
+	}
+
+	mail, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AdminMail, error) {
+		var m AdminMail
+		var snowflake int64
+		err := row.Scan(&snowflake, &m.Sender, &m.IsSent, &m.Size, &m.AppID)
+		m.Snowflake = strconv.FormatInt(snowflake, 10)
+		return m, err
+	})
+	if err != nil {
+		return err
+	}
+
+	return printMailList(mail)
+}
+
+func printMailList(mail []AdminMail) error {
+	w := tabwriter.NewWriter(commandOutput, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SNOWFLAKE\tSENDER\tSTATUS\tSIZE\tAPP")
+	for _, m := range mail {
+		status := "queued"
+		if m.IsSent {
+			status = "sent"
+		}
+
+		appID := m.AppID
+		if appID == "" {
+			appID = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", m.Snowflake, m.Sender, status, m.Size, appID)
+	}
+
+	return w.Flush()
+}
+
+// mailInjectCommand queues an internet email for a Wii, converting it the same way inbound mail is.
+func mailInjectCommand(args []string) error {
+	flags := flag.NewFlagSet("mail inject", flag.ContinueOnError)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if flags.NArg() != 2 {
+		return errors.New("usage: mail inject <mlid> <file.eml>")
+	}
+
+	mlid, err := parseMlidArg(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	msg, err := readMessage(file)
+	if err != nil {
+		return err
+	}
+
+	to := fmt.Sprintf("w%s@%s", mlid, primaryDomain())
+	formulatedMail, err := formulateMessage(msg.From.Address, to, msg.Subject, msg)
+	if err != nil {
+		return err
+	}
+
+	snowflake := flakeNode.Generate()
+	_, err = pool.Exec(ctx, InsertMail, snowflake, formulatedMail, msg.From.Address, mlid, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(commandOutput, "Queued %d for w%s.\n", snowflake, mlid)
+	return nil
+}
+
+func mailPurgeCommand(args []string) error {
+	flags := flag.NewFlagSet("mail purge", flag.ContinueOnError)
+	sentOnly := flags.Bool("sent", false, "only purge mail that has already been sent to the Wii")
+	mlid, err := singleMlidArg(flags, args, "mail purge [-sent] <mlid>")
+	if err != nil {
+		return err
+	}
+
+	tag, err := pool.Exec(ctx, PurgeMail, mlid, *sentOnly)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(commandOutput, "Purged %d messages for w%s.\n", tag.RowsAffected(), mlid)
+	return nil
+}
+
+func inboundRunOnceCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: inbound run-once")
+	}
+
+	processed, err := processInboundOnce()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(commandOutput, "Processed %d objects.\n", processed)
+	return nil
+}
+
+// checkConfig returns every problem found with the loaded config.
+func checkConfig() []string {
+	var problems []string
+	required := map[string]string{
+		"Address":    config.Address,
+		"SQLAddress": config.SQLAddress,
+		"SQLUser":    config.SQLUser,
+		"SQLDB":      config.SQLDB,
+		"AWSBucket":  config.AWSBucket,
+		"AWSRegion":  config.AWSRegion,
+	}
+	for name, value := range required {
+		if value == "" {
+			problems = append(problems, fmt.Sprintf("%s is not set", name))
+		}
+	}
+
+	switch AnimatedImageMode(config.AnimatedImageMode) {
+	case "", AnimatedFirstFrame, AnimatedRepresentativeFrame, AnimatedContactSheet:
+	default:
+		problems = append(problems, fmt.Sprintf("AnimatedImageMode %s is not one of first, representative or contactsheet", config.AnimatedImageMode))
+	}
+
+	if isBlockedDomain(primaryDomain()) {
+		problems = append(problems, "PrimaryDomain is also in BlockedDomains")
+	}
+
+	if config.AdminAddress != "" && config.AdminAddress == config.Address {
+		problems = append(problems, "AdminAddress must not be the same as Address")
+	}
+
+	if config.AdminAddress != "" && len(config.AdminTokens) == 0 {
+		problems = append(problems, "AdminAddress is set without any AdminTokens")
+	}
+
+	if config.MlchkidKey == "" {
+		problems = append(problems, "MlchkidKey is not set, so mlchkids are stored as unsalted SHA-512")
+	}
+
+	if config.UseOTLP && config.OTLPEndpoint == "" {
+		problems = append(problems, "UseOTLP is set without an OTLPEndpoint")
+	}
+
+	return problems
+}
+
+// configCheckCommand validates config.xml and that the database and bucket can be reached with it.
+func configCheckCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: config check")
+	}
+
+	problems := checkConfig()
+
+	err := pool.Ping(ctx)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("unable to connect to the database: %v", err))
+	}
+
+	_, err = s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(config.AWSBucket)})
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("unable to access the bucket: %v", err))
+	}
+
+	if len(problems) == 0 {
+		fmt.Fprintln(commandOutput, "config.xml is valid.")
+		return nil
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintln(commandOutput, problem)
+	}
+
+	return fmt.Errorf("found %d problems with config.xml", len(problems))
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// TestCommandArguments checks that commands reject bad arguments before connecting to anything.
+func TestCommandArguments(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	missing := filepath.Join(_t.TempDir(), "missing.eml")
+	cases := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"account"}, "unknown command account"},
+		{[]string{"account", "rename", "w1000000000000016"}, "unknown command account rename"},
+		{[]string{"account", "create"}, "usage: account create <mlid>"},
+		{[]string{"account", "show", "w1234"}, "w1234 is not a valid Wii number"},
+		{[]string{"account", "delete", "w1000000000000016", "w1000000000000017"}, "usage: account delete <mlid>"},
+		{[]string{"account", "export", "w1000000000000016"}, "usage: account export <mlid> <file.mbox>"},
+		{[]string{"account", "token", "-ttl", "soon", "w1000000000000016"}, `invalid value "soon" for flag -ttl`},
+		{[]string{"mail", "list", "-status", "unknown", "w1000000000000016"}, "status must be queued or sent"},
+		{[]string{"mail", "list"}, "usage: mail list [-status queued|sent] <mlid>"},
+		{[]string{"mail", "inject", "w1000000000000016"}, "usage: mail inject <mlid> <file.eml>"},
+		{[]string{"mail", "inject", "1000000000000017", missing}, "no such file or directory"},
+		{[]string{"mail", "purge", "-sent"}, "usage: mail purge [-sent] <mlid>"},
+		{[]string{"mail", "purge", "-all", "w1000000000000016"}, "flag provided but not defined: -all"},
+		{[]string{"inbound", "run-once", "now"}, "usage: inbound run-once"},
+	}
+
+	for _, tc := range cases {
+		err := runCommand(tc.args)
+		if err == nil || !strings.Contains(err.Error(), tc.expected) {
+			_t.Errorf("%s: expected '%s', got '%v'", strings.Join(tc.args, " "), tc.expected, err)
+		}
+	}
+}
+
+func TestParseMlidArg(_t *testing.T) {
+	for _, arg := range []string{"1000000000000016", "w1000000000000016", "W1000000000000016"} {
+		mlid, err := parseMlidArg(arg)
+		if err != nil || mlid != "1000000000000016" {
+			_t.Errorf("%s: expected 1000000000000016, got '%s' and %v", arg, mlid, err)
+		}
+	}
+}
+
+func TestPrintAccount(_t *testing.T) {
+	var out bytes.Buffer
+	previous := commandOutput
+	commandOutput = &out
+	defer func() { commandOutput = previous }()
+
+	printAccount(AdminAccount{Mlid: "1000000000000016", ContactPolicy: "hold", QueuedMail: 2, QueuedBytes: 1024, SentMail: 1, SentBytes: 512})
+	expected := "mlid:           w1000000000000016\n" +
+		"contact policy: hold\n" +
+		"queued mail:    2 (1024 bytes)\n" +
+		"sent mail:      1 (512 bytes)\n"
+	if out.String() != expected {
+		_t.Errorf("Incorrect output.\n\n Expected: '%s'\n\n Got: '%s'", expected, out.String())
+	}
+}
+
+func TestPrintMailList(_t *testing.T) {
+	var out bytes.Buffer
+	previous := commandOutput
+	commandOutput = &out
+	defer func() { commandOutput = previous }()
+
+	err := printMailList([]AdminMail{
+		{Snowflake: "1234", Sender: "1000000000000017", Size: 615},
+		{Snowflake: "5678", Sender: "friend@example.com", IsSent: true, Size: 42, AppID: "1-48434a45-0001"},
+	})
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	expected := "SNOWFLAKE  SENDER              STATUS  SIZE  APP\n" +
+		"1234       1000000000000017    queued  615   -\n" +
+		"5678       friend@example.com  sent    42    1-48434a45-0001\n"
+	if out.String() != expected {
+		_t.Errorf("Incorrect output.\n\n Expected: '%s'\n\n Got: '%s'", expected, out.String())
+	}
+}
+
+// TestInboundRunOnceCommand processes a bucket holding one object that is not an email, which is deleted
+// without reaching the database.
+func TestInboundRunOnceCommand(_t *testing.T) {
+	config = &Config{AWSBucket: "inbound"}
+	var out bytes.Buffer
+	previousClient, previousOutput := s3Client, commandOutput
+	commandOutput = &out
+	defer func() {
+		config = nil
+		s3Client, commandOutput = previousClient, previousOutput
+	}()
+
+	var deleted []string
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Has("list-type"):
+			w.Header().Set("Content-Type", "application/xml")
+			_, _ = io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?>
+<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>inbound</Name><IsTruncated>false</IsTruncated>`+
+				`<Contents><Key>first</Key></Contents></ListBucketResult>`)
+		default:
+			_, _ = io.WriteString(w, "this is not an email")
+		}
+	}))
+	defer bucket.Close()
+
+	s3Client = s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(bucket.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+
+	err := runCommand([]string{"inbound", "run-once"})
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	if out.String() != "Processed 1 objects.\n" {
+		_t.Errorf("Incorrect output '%s'", out.String())
+	}
+
+	if len(deleted) != 1 || deleted[0] != "/inbound/first" {
+		_t.Errorf("Expected the object to be deleted, got %v", deleted)
+	}
+}
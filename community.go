@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/WiiLink24/Mail-Server/secrets"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	InsertCommunity        = `INSERT INTO communities (slug, name, token_hash, created_by) VALUES ($1, $2, $3, $4) RETURNING id`
+	QueryCommunity         = `SELECT id, slug, name FROM communities WHERE slug = $1`
+	QueryCommunityForToken = `SELECT id, slug, name FROM communities WHERE slug = $1 AND token_hash = $2`
+	QueryCommunities       = `SELECT c.id, c.slug, c.name, c.created_by, c.created_at, COUNT(s.mlid) FROM communities c
+		LEFT JOIN community_subscriptions s ON s.community_id = c.id GROUP BY c.id ORDER BY c.id`
+	InsertSubscription = `INSERT INTO community_subscriptions (community_id, mlid) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	DeleteSubscription = `DELETE FROM community_subscriptions WHERE community_id = $1 AND mlid = $2`
+	CountSubscribers   = `SELECT COUNT(*) FROM community_subscriptions WHERE community_id = $1`
+
+	// Consoles subscribe by sending mail to subscribe-<slug>@ our domain, and unsubscribe with unsubscribe-<slug>@.
+	CommunitySubscribePrefix   = "subscribe-"
+	CommunityUnsubscribePrefix = "unsubscribe-"
+	// Messages from a community are sent from community-<slug>@ our domain.
+	CommunitySenderPrefix = "community-"
+
+	CommunityTokenLength = 32
+	// maxComposedImageSize is the largest image that can be uploaded through an API. It is resized to fit in a message.
+	maxComposedImageSize = 10 << 20
+	maxComposedSubject   = 100
+)
+
+var (
+	ErrCommunityNotFound    = errors.New("community does not exist")
+	ErrInvalidCommunitySlug = errors.New("community names in addresses must be 1 to 32 lowercase letters, digits or dashes")
+	ErrInvalidCommunityName = errors.New("community names must be set, on one line and at most 100 characters")
+	ErrInvalidSubject       = errors.New("subject must be set, on one line and at most 100 characters")
+)
+
+var communitySlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// Community is a group of accounts a creator can send messages to.
+type Community struct {
+	ID   int64  `json:"-"`
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+// communityAddress returns the address a community's messages are sent from.
+func communityAddress(slug string) string {
+	return fmt.Sprintf("%s%s@%s", CommunitySenderPrefix, slug, primaryDomain())
+}
+
+// parseCommunityCommand reports whether a local recipient is a request to subscribe or unsubscribe from a community.
+func parseCommunityCommand(local string) (subscribe bool, slug string, ok bool) {
+	local = strings.ToLower(local)
+	if slug, found := strings.CutPrefix(local, CommunitySubscribePrefix); found && communitySlugPattern.MatchString(slug) {
+		return true, slug, true
+	}
+
+	if slug, found := strings.CutPrefix(local, CommunityUnsubscribePrefix); found && communitySlugPattern.MatchString(slug) {
+		return false, slug, true
+	}
+
+	return false, "", false
+}
+
+func getCommunity(ctx context.Context, slug string) (Community, error) {
+	var community Community
+	err := pool.QueryRow(ctx, QueryCommunity, slug).Scan(&community.ID, &community.Slug, &community.Name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Community{}, ErrCommunityNotFound
+	}
+
+	return community, err
+}
+
+// createCommunity creates a community and returns the token its creator sends messages with.
+func createCommunity(ctx context.Context, slug, name, actor string) (string, error) {
+	if !communitySlugPattern.MatchString(slug) {
+		return "", ErrInvalidCommunitySlug
+	}
+
+	// The name is the subject of the messages sent when subscribing.
+	if !validSubject(name) {
+		return "", ErrInvalidCommunityName
+	}
+
+	token := secrets.String(CommunityTokenLength)
+	_, err := pool.Exec(ctx, InsertCommunity, slug, name, hashPassword(token), actor)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Community %s created by %s", slug, actor)
+	return token, nil
+}
+
+// changeSubscription subscribes or unsubscribes an account, telling it what happened with a message from the community.
+// mlid is expected without the w.
+func changeSubscription(ctx context.Context, subscribe bool, slug, mlid string) error {
+	community, err := getCommunity(ctx, slug)
+	if err != nil {
+		return err
+	}
+
+	query, text := DeleteSubscription, fmt.Sprintf("You have unsubscribed from %s.", community.Name)
+	if subscribe {
+		query = InsertSubscription
+		text = fmt.Sprintf("You have subscribed to %s.\r\n\r\nTo stop receiving its messages, send a message to %s%s@%s.",
+			community.Name, CommunityUnsubscribePrefix, slug, primaryDomain())
+	}
+
+	tag, err := pool.Exec(ctx, query, community.ID, mlid)
+	if err != nil || tag.RowsAffected() == 0 {
+		// Nothing changed, so there is nothing to tell the account.
+		return err
+	}
+
+	from := communityAddress(slug)
+	formulatedMail, err := formulateMessage(from, fmt.Sprintf("w%s@%s", mlid, primaryDomain()), community.Name, &Message{Text: text})
+	if err != nil {
+		return err
+	}
+
+	snowflake := flakeNode.Generate().Int64()
+	_, err = pool.Exec(ctx, InsertMail, snowflake, formulatedMail, from, mlid, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	checkCache.MailQueued(mlid, snowflake)
+	return nil
+}
+
+// sendToCommunity stores a message once as a broadcast to the community's subscribers and starts sending it.
+// Like any broadcast, it carries on where it stopped if the server is restarted.
+func sendToCommunity(ctx context.Context, community Community, subject string, msg *Message) (Broadcast, error) {
+	broadcast, err := createBroadcast(ctx, subject, msg, BroadcastSelector{Community: &community}, CommunitySenderPrefix+community.Slug)
+	if err != nil {
+		return Broadcast{}, err
+	}
+
+	startBroadcast(broadcast.ID)
+	return broadcast, nil
+}
+
+// communityAuth authenticates a creator with the bearer token given when their community was created.
+func communityAuth(c *gin.Context) {
+	header := c.GetHeader("Authorization")
+	if !strings.HasPrefix(header, AdminTokenPrefix) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing bearer token"})
+		return
+	}
+
+	var community Community
+	token := strings.TrimPrefix(header, AdminTokenPrefix)
+	err := pool.QueryRow(c, QueryCommunityForToken, c.Param("slug"), hashPassword(token)).Scan(&community.ID, &community.Slug, &community.Name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		c.Abort()
+		return
+	}
+
+	c.Set("community", community)
+	c.Next()
+}
+
+func creatorGetCommunity(c *gin.Context) {
+	community := c.MustGet("community").(Community)
+
+	var subscribers int64
+	err := pool.QueryRow(c, CountSubscribers, community.ID).Scan(&subscribers)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"community":   community,
+		"address":     fmt.Sprintf("%s%s@%s", CommunitySubscribePrefix, community.Slug, primaryDomain()),
+		"subscribers": subscribers,
+	})
+}
+
+// validSubject reports whether a subject can be placed in a header as is.
+func validSubject(subject string) bool {
+	return subject != "" && len(subject) <= maxComposedSubject && !strings.ContainsAny(subject, "\r\n")
+}
+
+// composedMessage reads a message written through an API from a multipart form with subject, text and optionally
+// an image, which is converted for the Wii like images in internet mail. The error response is written if it is invalid.
+func composedMessage(c *gin.Context) (string, *Message, bool) {
+	subject := c.PostForm("subject")
+	if !validSubject(subject) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidSubject.Error()})
+		return "", nil, false
+	}
+
+	msg := &Message{Text: c.PostForm("text")}
+	if msg.Text == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "text must be set"})
+		return "", nil, false
+	}
+
+	if header, err := c.FormFile("image"); err == nil {
+		if header.Size > maxComposedImageSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "image is too large"})
+			return "", nil, false
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			adminError(c, err)
+			return "", nil, false
+		}
+		defer file.Close()
+
+		msg.Attachment, err = io.ReadAll(io.LimitReader(file, maxComposedImageSize))
+		if err != nil {
+			adminError(c, err)
+			return "", nil, false
+		}
+	}
+
+	return subject, msg, true
+}
+
+// creatorSendMessage sends a message to every subscriber of a community. It takes a form read by composedMessage.
+func creatorSendMessage(c *gin.Context) {
+	community := c.MustGet("community").(Community)
+
+	subject, msg, ok := composedMessage(c)
+	if !ok {
+		return
+	}
+
+	broadcast, err := sendToCommunity(c, community, subject, msg)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	log.Printf("Community %s is sending a message to %d subscribers", community.Slug, broadcast.Total)
+	if config.UseDatadog {
+		err = dataDog.Incr("mail.community_messages", []string{"community:" + community.Slug}, float64(broadcast.Total))
+		if err != nil {
+			ReportErrorGin(c, err)
+		}
+	}
+
+	c.JSON(http.StatusAccepted, broadcast)
+}
+
+// creatorGetMessage reports how many subscribers a message from the community has been sent to.
+func creatorGetMessage(c *gin.Context) {
+	community := c.MustGet("community").(Community)
+	id, ok := adminBroadcastID(c)
+	if !ok {
+		return
+	}
+
+	broadcast, err := scanBroadcast(pool.QueryRow(c, QueryCommunityBroadcast, id, community.ID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": ErrBroadcastNotFound.Error()})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, broadcast)
+}
+
+// registerCommunityAPI serves the creator API on the main server, as creators are not operators.
+func registerCommunityAPI(g *gin.Engine) {
+	api := g.Group("/api/communities/:slug", communityAuth)
+	api.GET("", creatorGetCommunity)
+	api.POST("/messages", creatorSendMessage)
+	api.GET("/messages/:id", creatorGetMessage)
+}
+
+// adminCreateCommunity creates a community from a JSON body with slug and name, returning the creator's token.
+func adminCreateCommunity(c *gin.Context) {
+	var body struct {
+		Slug  string `json:"slug"`
+		Name  string `json:"name"`
+		Actor string `json:"actor"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be JSON with slug and name"})
+		return
+	}
+
+	token, err := createCommunity(c, body.Slug, body.Name, body.Actor)
+	if errors.Is(err, ErrInvalidCommunitySlug) || errors.Is(err, ErrInvalidCommunityName) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"slug": body.Slug, "token": token})
+}
+
+// runCommunityCommand handles the community admin subcommand:
+//
+//	community create [-actor name] <slug> <name>
+//	community list
+func runCommunityCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: community <create|list> ...")
+	}
+
+	flags := flag.NewFlagSet("community "+args[0], flag.ContinueOnError)
+	actor := flags.String("actor", os.Getenv("USER"), "operator responsible for the change")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "create":
+		if flags.NArg() != 2 {
+			return errors.New("usage: community create [-actor name] <slug> <name>")
+		}
+
+		token, err := createCommunity(ctx, flags.Arg(0), flags.Arg(1), *actor)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Created community %s. Its creator's token is %s\n", flags.Arg(0), token)
+		fmt.Printf("Consoles subscribe by sending a message to %s%s@%s\n", CommunitySubscribePrefix, flags.Arg(0), primaryDomain())
+	case "list":
+		rows, err := pool.Query(ctx, QueryCommunities)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSLUG\tNAME\tBY\tCREATED\tSUBSCRIBERS")
+		for rows.Next() {
+			var community Community
+			var createdBy string
+			var createdAt time.Time
+			var subscribers int64
+			err = rows.Scan(&community.ID, &community.Slug, &community.Name, &createdBy, &createdAt, &subscribers)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\n", community.ID, community.Slug, community.Name, createdBy, createdAt.Format(time.DateTime), subscribers)
+		}
+
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown community command %s", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseCommunityCommand(_t *testing.T) {
+	cases := []struct {
+		local     string
+		subscribe bool
+		slug      string
+		ok        bool
+	}{
+		{"subscribe-news", true, "news", true},
+		{"Unsubscribe-Wii-Fans", false, "wii-fans", true},
+		{"subscribe-", false, "", false},
+		{"subscribe--news", false, "", false},
+		{"subscribe-news@", false, "", false},
+		{"w1234567890123456", false, "", false},
+		{"community-news", false, "", false},
+	}
+
+	for _, tc := range cases {
+		subscribe, slug, ok := parseCommunityCommand(tc.local)
+		if subscribe != tc.subscribe || slug != tc.slug || ok != tc.ok {
+			_t.Errorf("Incorrect command for %s.\n\n Expected: '%v %s %v'\n\n Got: '%v %s %v'", tc.local, tc.subscribe, tc.slug, tc.ok, subscribe, slug, ok)
+		}
+	}
+}
+
+func TestValidSubject(_t *testing.T) {
+	if !validSubject("Weekly news") {
+		_t.Errorf("Expected a plain subject to be valid")
+	}
+
+	for _, subject := range []string{"", "News\r\nBcc: w1234567890123456@rc24.xyz", string(make([]byte, maxComposedSubject+1))} {
+		if validSubject(subject) {
+			_t.Errorf("Expected %q to be invalid", subject)
+		}
+	}
+}
+
+func TestCommunityAuth(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	registerCommunityAPI(g)
+
+	// Requests without a token are refused before the database is queried.
+	req := httptest.NewRequest(http.MethodPost, "/api/communities/news/messages", nil)
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		_t.Errorf("Expected 401, got %d", w.Code)
+	}
+
+	if address := communityAddress("news"); address != "community-news@rc24.xyz" {
+		_t.Errorf("Incorrect address '%s'", address)
+	}
+}
+
+// TestCommunityBroadcast checks messages from a community are stored once and only sent to its subscribers.
+func TestCommunityBroadcast(_t *testing.T) {
+	config = &Config{Broadcasts: BroadcastConfig{BatchSize: 1}}
+	previousCache := checkCache
+	defer func() {
+		config = nil
+		checkCache = previousCache
+	}()
+	testDatabase(_t)
+	checkCache = NewCheckCache()
+
+	subscriber, other := "1000000000000016", "1000000000000017"
+	createTestAccounts(_t, subscriber, other)
+
+	// Communities cannot be deleted, so each run has its own.
+	slug := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	_, err := createCommunity(context.Background(), slug, "Test", "test")
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	err = changeSubscription(context.Background(), true, slug, subscriber)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	community, err := getCommunity(context.Background(), slug)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	broadcast, err := createBroadcast(context.Background(), "News", &Message{Text: "Hello"}, BroadcastSelector{Community: &community}, "test")
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	if broadcast.Total != 1 {
+		_t.Errorf("Expected one subscriber, got %d", broadcast.Total)
+	}
+
+	err = runBroadcast(context.Background(), broadcast.ID, nil)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	var recipients []string
+	var sender string
+	rows, err := pool.Query(context.Background(), `SELECT recipient, sender FROM mail WHERE broadcast_id = $1`, broadcast.ID)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	for rows.Next() {
+		var recipient string
+		err = rows.Scan(&recipient, &sender)
+		if err != nil {
+			_t.Fatal(err)
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	if rows.Err() != nil {
+		_t.Fatal(rows.Err())
+	}
+
+	if len(recipients) != 1 || recipients[0] != subscriber {
+		_t.Errorf("Expected only %s to be sent the message, got %v", subscriber, recipients)
+	}
+
+	if sender != communityAddress(slug) {
+		_t.Errorf("Incorrect sender.\n\n Expected: '%s'\n\n Got: '%s'", communityAddress(slug), sender)
+	}
+}
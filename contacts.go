@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	QueryContactPolicy  = `SELECT accounts.contact_policy, EXISTS(SELECT 1 FROM contacts WHERE contacts.mlid = accounts.mlid AND contact = $2) FROM accounts WHERE mlid = $1`
+	InsertContact       = `INSERT INTO contacts (mlid, contact) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+	DeleteContact       = `DELETE FROM contacts WHERE mlid = $1 AND contact = $2`
+	QueryContacts       = `SELECT contact FROM contacts WHERE mlid = $1 ORDER BY contact`
+	UpdateContactPolicy = `UPDATE accounts SET contact_policy = $2 WHERE mlid = $1`
+)
+
+// ContactPolicy determines what happens to mail from senders that are not in an account's contacts.
+type ContactPolicy string
+
+const (
+	// ContactPolicyOff delivers all mail, as the Wii does its own filtering.
+	ContactPolicyOff ContactPolicy = "off"
+	// ContactPolicyHold quarantines mail from unknown senders.
+	ContactPolicyHold ContactPolicy = "hold"
+	// ContactPolicyDrop discards mail from unknown senders.
+	ContactPolicyDrop ContactPolicy = "drop"
+)
+
+const ReasonUnknownContact = "contacts: sender is not in the recipient's contacts"
+
+var ErrRecipientNotFound = errors.New("recipient does not exist")
+
+func isValidContactPolicy(policy string) bool {
+	switch ContactPolicy(policy) {
+	case ContactPolicyOff, ContactPolicyHold, ContactPolicyDrop:
+		return true
+	default:
+		return false
+	}
+}
+
+// normalizeContact returns the form contacts are stored in: a Wii number with its w, or a lowercase email address.
+func normalizeContact(contact string) string {
+	contact = strings.ToLower(strings.TrimSpace(contact))
+	local, domain, found := strings.Cut(contact, "@")
+	if found && isLocalDomain(domain) {
+		// Wii numbers are stored without a domain so aliases match.
+		return local
+	}
+
+	return contact
+}
+
+// contactPolicyFor returns the recipient's policy and whether the sender is one of their contacts.
+// ErrRecipientNotFound is returned if the recipient has no account.
+func contactPolicyFor(ctx context.Context, recipient, sender string) (ContactPolicy, bool, error) {
+	var policy string
+	var known bool
+	err := pool.QueryRow(ctx, QueryContactPolicy, recipient, normalizeContact(sender)).Scan(&policy, &known)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, ErrRecipientNotFound
+	} else if err != nil {
+		return "", false, err
+	}
+
+	return ContactPolicy(policy), known, nil
+}
+
+const (
+	// FriendRegistrationCommand is the X-Wii-Cmd of friend registration mail.
+	FriendRegistrationCommand = "80010001"
+	friendRegistrationSubject = "WC24 Cmd Message"
+	friendRegistrationAppID   = "0-00000001-0001"
+)
+
+// friendRegistrationHeaders are the only headers friend registration mail has.
+var friendRegistrationHeaders = []string{
+	"Date", "From", "To", "Message-Id", "Subject", "X-Wii-Appid", "X-Wii-Cmd", "Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// isFriendRegistration reports whether a message from mlid is friend registration, which a Wii sends as a plain text
+// "WC24 Cmd Message" whose body is the sender's own address. It comes from a Wii that is not a contact yet by design,
+// so contact policies do not apply to it. Every header and line of the body has to match, as the message can be
+// written by anyone with an account: an X-Wii-Cmd header alone is not enough.
+func isFriendRegistration(data, mlid string) bool {
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(data)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return false
+	}
+
+	for key := range header {
+		if !slices.Contains(friendRegistrationHeaders, key) {
+			return false
+		}
+	}
+
+	if header.Get("X-Wii-Cmd") != FriendRegistrationCommand || header.Get("Subject") != friendRegistrationSubject {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "text/plain" {
+		return false
+	}
+
+	if encoding := strings.ToLower(header.Get("Content-Transfer-Encoding")); encoding != "" && encoding != "7bit" {
+		return false
+	}
+
+	from, err := mail.ParseAddress(header.Get("From"))
+	if err != nil || !isOwnAddress(from.Address, mlid) {
+		return false
+	}
+
+	body, err := io.ReadAll(reader.R)
+	if err != nil {
+		return false
+	}
+
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n"), "\n")
+	if len(lines) != 2 || lines[0] != friendRegistrationSubject {
+		return false
+	}
+
+	address, mailto, found := strings.Cut(lines[1], " ")
+	return found && isOwnAddress(address, mlid) && mailto == "<mailto:"+address+">"
+}
+
+// isOwnAddress reports whether address is mlid at one of our domains.
+func isOwnAddress(address, mlid string) bool {
+	local, domain, found := strings.Cut(address, "@")
+	return found && strings.EqualFold(local, mlid) && isLocalDomain(domain)
+}
+
+// buildFriendRegistration writes the friend registration mail from mlid to recipient, both being Wii numbers with their w.
+// It is delivered in place of what the sender wrote, so nothing but the registration can reach a stranger.
+func buildFriendRegistration(id int64, mlid, recipient string, date time.Time) string {
+	from := fmt.Sprintf("%s@%s", mlid, primaryDomain())
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Date: %s\r\n", date.UTC().Format("Mon, 02 Jan 2006 15:04:05 -0000"))
+	fmt.Fprintf(&builder, "From: %s\r\n", from)
+	fmt.Fprintf(&builder, "To: %s@%s\r\n", recipient, primaryDomain())
+	fmt.Fprintf(&builder, "Message-Id: <%016X.0001@%s>\r\n", id, primaryDomain())
+	fmt.Fprintf(&builder, "Subject: %s\r\n", friendRegistrationSubject)
+	fmt.Fprintf(&builder, "X-Wii-AppId: %s\r\n", friendRegistrationAppID)
+	fmt.Fprintf(&builder, "X-Wii-Cmd: %s\r\n", FriendRegistrationCommand)
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=us-ascii\r\n\r\n")
+	fmt.Fprintf(&builder, "%s\r\n%s <mailto:%s>\r\n", friendRegistrationSubject, from, from)
+
+	return builder.String()
+}
+
+// recordContacts adds recipients to the contacts of a Wii.
+// A Wii can only send mail to addresses registered in its address book, so every recipient
+// of outgoing mail, friend registration mail included, is a contact.
+func recordContacts(ctx context.Context, mlid string, recipients []string) error {
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, recipient := range recipients {
+		batch.Queue(InsertContact, mlid, normalizeContact(recipient))
+	}
+
+	return pool.SendBatch(ctx, batch).Close()
+}
+
+// contacts allows a Wii's contacts and policy to be viewed and edited.
+// Actions are list, add, remove and policy.
+func contacts(r *Response) {
+	mlid := r.PostForm("mlid")
+	password := r.PostForm("passwd")
+
+	ctx := r.Context()
+	err := validatePassword(ctx, mlid, password, r.ClientIP())
+	if errors.Is(err, ErrInvalidCredentials) {
+		cgi := GenCGIError(CGICodeInvalidCredentials, err.Error())
+		r.WriteCGI(cgi)
+		return
+	} else if cgi, banned := banResponse(err); banned {
+		r.WriteCGI(cgi)
+		return
+	} else if err != nil {
+		cgi := GenCGIError(CGICodeServerError, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
+		return
+	}
+
+	cgi := GenCGISuccess()
+
+	contact := normalizeContact(r.PostForm("contact"))
+	switch r.PostForm("action") {
+	case "list":
+		rows, err := pool.Query(ctx, QueryContacts, mlid[1:])
+		if err != nil {
+			cgi = GenCGIError(CGICodeServerError, "An error has occurred while querying the database.")
+			r.ReportError(err)
+			break
+		}
+
+		entries, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			cgi = GenCGIError(CGICodeServerError, "An error has occurred while querying the database.")
+			r.ReportError(err)
+			break
+		}
+
+		cgi.Add("contactnum", strconv.Itoa(len(entries)))
+		for i, entry := range entries {
+			cgi.Add("contact"+strconv.Itoa(i+1), entry)
+		}
+	case "add", "remove":
+		if contact == "" {
+			cgi = GenCGIError(CGICodeInvalidParameter, "contact not found")
+			break
+		}
+
+		query := InsertContact
+		if r.PostForm("action") == "remove" {
+			query = DeleteContact
+		}
+
+		_, err = pool.Exec(ctx, query, mlid[1:], contact)
+		if err != nil {
+			cgi = GenCGIError(CGICodeStorageFailed, "Database error.")
+			r.ReportError(err)
+		}
+	case "policy":
+		policy := r.PostForm("policy")
+		if !isValidContactPolicy(policy) {
+			cgi = GenCGIError(CGICodeInvalidParameter, "Invalid policy. Expected off, hold or drop.")
+			break
+		}
+
+		_, err = pool.Exec(ctx, UpdateContactPolicy, mlid[1:], policy)
+		if err != nil {
+			cgi = GenCGIError(CGICodeStorageFailed, "Database error.")
+			r.ReportError(err)
+		}
+	default:
+		cgi = GenCGIError(CGICodeInvalidParameter, "Invalid action.")
+	}
+
+	r.WriteCGI(cgi)
+}
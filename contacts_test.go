@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNormalizeContact(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	cases := map[string]string{
+		"W1234567890123456@rc24.xyz":           "w1234567890123456",
+		"w1234567890123456@mail.wiilink24.com": "w1234567890123456",
+		" Friend@Example.com ":                 "friend@example.com",
+		// The legacy domain is not ours, so it is kept like any other email address.
+		"w1234567890123456@wii.com": "w1234567890123456@wii.com",
+	}
+
+	for contact, expected := range cases {
+		if got := normalizeContact(contact); got != expected {
+			_t.Errorf("%s: expected %s, got %s", contact, expected, got)
+		}
+	}
+}
+
+func TestContactsCGI(_t *testing.T) {
+	config = &Config{}
+	previousCache, previousLimiter := checkCache, authLimiter
+	defer func() {
+		config = nil
+		checkCache, authLimiter = previousCache, previousLimiter
+	}()
+	testDatabase(_t)
+	checkCache, authLimiter = NewCheckCache(), NewAuthLimiter()
+
+	mlid := "1000000000000016"
+	passwd := createTestAccounts(_t, mlid)
+	g := newTestCGIServer()
+
+	contacts := func(form url.Values) string {
+		form.Set("mlid", "w"+mlid)
+		form.Set("passwd", passwd)
+		return postCGI(g, "/cgi-bin/contacts.cgi", form)
+	}
+
+	for _, contact := range []string{"w1000000000000017@rc24.xyz", "Friend@Example.com"} {
+		if got := contacts(url.Values{"action": {"add"}, "contact": {contact}}); !strings.HasPrefix(got, "cd=100\n") {
+			_t.Fatalf("Adding %s failed.\n\n Got: '%s'", contact, got)
+		}
+	}
+
+	expected := "cd=100\nmsg=Success.\ncontactnum=2\ncontact1=friend@example.com\ncontact2=w1000000000000017\n"
+	if got := contacts(url.Values{"action": {"list"}}); got != expected {
+		_t.Errorf("Incorrect contacts.\n\n Expected: '%s'\n\n Got: '%s'", expected, got)
+	}
+
+	contacts(url.Values{"action": {"remove"}, "contact": {"friend@example.com"}})
+	expected = "cd=100\nmsg=Success.\ncontactnum=1\ncontact1=w1000000000000017\n"
+	if got := contacts(url.Values{"action": {"list"}}); got != expected {
+		_t.Errorf("Incorrect contacts after removing one.\n\n Expected: '%s'\n\n Got: '%s'", expected, got)
+	}
+
+	invalid := []url.Values{
+		{"action": {"add"}},
+		{"action": {"policy"}, "policy": {"block"}},
+		{"action": {"unknown"}},
+	}
+
+	for _, form := range invalid {
+		if got := contacts(form); !strings.HasPrefix(got, "cd=360\n") {
+			_t.Errorf("%v: expected an invalid parameter.\n\n Got: '%s'", form, got)
+		}
+	}
+
+	if got := contacts(url.Values{"action": {"policy"}, "policy": {"hold"}}); !strings.HasPrefix(got, "cd=100\n") {
+		_t.Fatalf("Setting the policy failed.\n\n Got: '%s'", got)
+	}
+
+	policy, known, err := contactPolicyFor(context.Background(), mlid, "w1000000000000017@rc24.xyz")
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	if policy != ContactPolicyHold || !known {
+		_t.Errorf("Expected hold with a known contact, got %s and %v", policy, known)
+	}
+}
+
+// TestContactPolicies sends mail from a stranger under each policy, then from a contact.
+func TestContactPolicies(_t *testing.T) {
+	config = &Config{}
+	previousCache, previousLimiter := checkCache, authLimiter
+	defer func() {
+		config = nil
+		checkCache, authLimiter = previousCache, previousLimiter
+	}()
+	testDatabase(_t)
+	checkCache, authLimiter = NewCheckCache(), NewAuthLimiter()
+
+	sender, recipient := "1000000000000016", "1000000000000017"
+	g := newTestCGIServer()
+	admin := newAdminRouter()
+
+	cases := []struct {
+		policy    ContactPolicy
+		delivered bool
+		held      int
+	}{
+		{ContactPolicyOff, true, 0},
+		{ContactPolicyHold, false, 1},
+		{ContactPolicyDrop, false, 0},
+	}
+
+	for _, tc := range cases {
+		passwd := createTestAccounts(_t, sender, recipient)
+		_, err := pool.Exec(context.Background(), UpdateContactPolicy, recipient, tc.policy)
+		if err != nil {
+			_t.Fatal(err)
+		}
+
+		if got := sendFixture(_t, g, "wii_to_wii.txt", sender, recipient, passwd); !strings.Contains(got, "cd1=100\n") {
+			_t.Fatalf("%s: sending failed.\n\n Got: '%s'", tc.policy, got)
+		}
+
+		got := receiveMail(_t, g, recipient, passwd)
+		if delivered := strings.Contains(got, "mailnum=1\n"); delivered != tc.delivered {
+			_t.Errorf("%s: expected delivered to be %v.\n\n Got: '%s'", tc.policy, tc.delivered, got)
+		}
+
+		// Held mail is listed under the recipient's mlid, the same as in mail.
+		w := adminRequest(admin, http.MethodGet, "/admin/accounts/w"+recipient+"/quarantine", nil)
+		var held struct {
+			Mail []AdminQuarantinedMail `json:"mail"`
+		}
+		err = json.Unmarshal(w.Body.Bytes(), &held)
+		if err != nil {
+			_t.Fatal(err)
+		}
+
+		if len(held.Mail) != tc.held {
+			_t.Fatalf("%s: expected %d held, got %d", tc.policy, tc.held, len(held.Mail))
+		}
+
+		if tc.held == 0 {
+			continue
+		}
+
+		if held.Mail[0].Sender != sender || held.Mail[0].Reason != ReasonUnknownContact {
+			_t.Errorf("Incorrect held mail %+v", held.Mail[0])
+		}
+
+		w = adminRequest(admin, http.MethodPost, "/admin/quarantine/"+held.Mail[0].Snowflake+"/release", nil)
+		if w.Code != http.StatusOK {
+			_t.Fatalf("Releasing failed with %d: %s", w.Code, w.Body.String())
+		}
+
+		if got := receiveMail(_t, g, recipient, passwd); !strings.Contains(got, "mailnum=1\n") {
+			_t.Errorf("Expected the released mail to be delivered.\n\n Got: '%s'", got)
+		}
+
+		if w := adminRequest(admin, http.MethodPost, "/admin/quarantine/"+held.Mail[0].Snowflake+"/release", nil); w.Code != http.StatusNotFound {
+			_t.Errorf("Expected releasing twice to be not found, got %d", w.Code)
+		}
+	}
+
+	// Contacts are delivered to whatever the policy.
+	passwd := createTestAccounts(_t, sender, recipient)
+	_, err := pool.Exec(context.Background(), UpdateContactPolicy, recipient, ContactPolicyDrop)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	_, err = pool.Exec(context.Background(), InsertContact, recipient, "w"+sender)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	sendFixture(_t, g, "wii_to_wii.txt", sender, recipient, passwd)
+	if got := receiveMail(_t, g, recipient, passwd); !strings.Contains(got, "mailnum=1\n") {
+		_t.Errorf("Expected mail from a contact to be delivered.\n\n Got: '%s'", got)
+	}
+}
+
+func postCGI(g *gin.Engine, path string, form url.Values) string {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	return w.Body.String()
+}
@@ -2,66 +2,61 @@ package main
 
 import (
 	"errors"
-	"github.com/gin-gonic/gin"
-	"net/http"
 	"strconv"
 )
 
 const DeleteSentMail = `DELETE FROM mail WHERE is_sent = true AND recipient = $1`
 
-func _delete(c *gin.Context) {
-	mlid := c.PostForm("mlid")
-	password := c.PostForm("passwd")
+func _delete(r *Response) {
+	mlid := r.PostForm("mlid")
+	password := r.PostForm("passwd")
 
-	ctx := c.Copy()
-	err := validatePassword(ctx, mlid, password)
+	ctx := r.Context()
+	err := validatePassword(ctx, mlid, password, r.ClientIP())
 	if errors.Is(err, ErrInvalidCredentials) {
-		cgi := GenCGIError(250, err.Error())
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeInvalidCredentials, err.Error())
+		r.WriteCGI(cgi)
+		return
+	} else if cgi, banned := banResponse(err); banned {
+		r.WriteCGI(cgi)
 		return
 	} else if err != nil {
-		cgi := GenCGIError(551, "An error has occurred while querying the database.")
-		ReportErrorGin(c, err)
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeServerError, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
 		return
 	}
 
 	// We are sent the number of messages to delete, however we will ignore it as
 	// we set a flag for the messages that were already sent.
-	delNum := c.PostForm("delnum")
+	delNum := r.PostForm("delnum")
 	// Integer checking
 	intDelNum, err := strconv.ParseInt(delNum, 10, 64)
 	if err != nil {
-		cgi := GenCGIError(340, "Invalid delnum value was passed")
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeInvalidDelNum, "Invalid delnum value was passed")
+		r.WriteCGI(cgi)
 		return
 	}
 
 	_, err = pool.Exec(ctx, DeleteSentMail, mlid[1:])
 	if err != nil {
-		cgi := GenCGIError(541, "An error has occurred while deleting the messages from the database.")
-		ReportErrorGin(c, err)
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeDeleteFailed, "An error has occurred while deleting the messages from the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
 		return
 	}
 
-	cgi := CGIResponse{
-		code:    100,
-		message: "Success.",
-		other: []KV{
-			{
-				key:   "deletenum",
-				value: delNum,
-			},
-		},
-	}
+	checkCache.ForgetMailbox(mlid[1:])
+
+	cgi := GenCGISuccess()
+	cgi.Add("deletenum", delNum)
 
 	if config.UseDatadog {
 		err = dataDog.Incr("mail.deleted_mail", nil, float64(intDelNum))
 		if err != nil {
-			ReportErrorGin(c, err)
+			r.ReportError(err)
 		}
 	}
 
-	c.String(http.StatusOK, ConvertToCGI(cgi))
+	r.WriteCGI(cgi)
 }
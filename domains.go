@@ -0,0 +1,73 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	DefaultPrimaryDomain = "rc24.xyz"
+	// LegacyDomain is the domain Nintendo's servers used, still found in nwc24msg.cfg on unpatched consoles.
+	LegacyDomain = "wii.com"
+)
+
+var (
+	defaultAliasDomains   = []string{"mail.wiilink24.com"}
+	defaultBlockedDomains = []string{LegacyDomain}
+)
+
+// primaryDomain returns the domain Wii accounts are addressed with.
+func primaryDomain() string {
+	if config.PrimaryDomain == "" {
+		return DefaultPrimaryDomain
+	}
+
+	return strings.ToLower(config.PrimaryDomain)
+}
+
+// aliasDomains returns the other domains accepted as belonging to a Wii account.
+func aliasDomains() []string {
+	if len(config.AliasDomains) == 0 {
+		return defaultAliasDomains
+	}
+
+	return config.AliasDomains
+}
+
+// blockedDomains returns the domains that mail is never delivered to.
+func blockedDomains() []string {
+	if len(config.BlockedDomains) == 0 {
+		return defaultBlockedDomains
+	}
+
+	return config.BlockedDomains
+}
+
+// isLocalDomain reports whether domain is the primary domain or one of its aliases.
+func isLocalDomain(domain string) bool {
+	domain = strings.ToLower(domain)
+	if domain == primaryDomain() {
+		return true
+	}
+
+	return slices.ContainsFunc(aliasDomains(), func(alias string) bool {
+		return strings.EqualFold(alias, domain)
+	})
+}
+
+// isBlockedDomain reports whether domain is in the blocked list.
+func isBlockedDomain(domain string) bool {
+	return slices.ContainsFunc(blockedDomains(), func(blocked string) bool {
+		return strings.EqualFold(blocked, domain)
+	})
+}
+
+// addressDomain returns the part of an address after the @, or an empty string if there is none.
+func addressDomain(address string) string {
+	index := strings.LastIndex(address, "@")
+	if index == -1 {
+		return ""
+	}
+
+	return address[index+1:]
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+)
+
+var (
+	ErrEnvelopeNoSender        = errors.New("envelope has no MAIL FROM line")
+	ErrEnvelopeDuplicateSender = errors.New("envelope has more than one MAIL FROM line")
+	ErrEnvelopeNoRecipients    = errors.New("envelope has no RCPT TO lines")
+	ErrEnvelopeNoData          = errors.New("envelope has no DATA line")
+	ErrEnvelopeEmptyData       = errors.New("envelope has no message after DATA")
+	ErrEnvelopeUnknownCommand  = errors.New("unknown envelope command")
+	ErrEnvelopeOutOfOrder      = errors.New("envelope command is out of order")
+	ErrEnvelopeInvalidAddress  = errors.New("invalid envelope address")
+)
+
+// EnvelopeError reports which line of an envelope could not be parsed.
+type EnvelopeError struct {
+	Line int
+	Err  error
+}
+
+func (e *EnvelopeError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err.Error())
+}
+
+func (e *EnvelopeError) Unwrap() error {
+	return e.Err
+}
+
+// EnvelopeAddress is an address found in a MAIL FROM or RCPT TO line.
+type EnvelopeAddress struct {
+	Local  string
+	Domain string
+}
+
+func (a EnvelopeAddress) String() string {
+	return fmt.Sprintf("%s@%s", a.Local, a.Domain)
+}
+
+// Envelope is a single m<N> value sent to send.cgi.
+// The Wii sends each message wrapped in SMTP commands:
+//
+//	MAIL FROM: w1234567890123456@rc24.xyz
+//	RCPT TO: w6543210987654321@rc24.xyz
+//	RCPT TO: someone@example.com
+//	DATA
+//	<RFC 5322 message>
+type Envelope struct {
+	Sender     EnvelopeAddress
+	Recipients []EnvelopeAddress
+	// Data is the raw RFC 5322 message following the DATA line.
+	Data string
+}
+
+// ParseEnvelope parses the SMTP-like envelope of a message sent by a Wii.
+func ParseEnvelope(content string) (*Envelope, error) {
+	envelope := &Envelope{}
+	hasSender := false
+	offset := 0
+	for lineNumber := 1; offset < len(content); lineNumber++ {
+		end := strings.IndexByte(content[offset:], '\n')
+		next := len(content)
+		if end != -1 {
+			next = offset + end + 1
+		}
+
+		line := strings.TrimRight(content[offset:next], "\r\n")
+		offset = next
+
+		if line == "" {
+			// Blank lines between commands carry no meaning.
+			continue
+		}
+
+		command, argument, _ := strings.Cut(line, ":")
+		switch {
+		case line == "DATA":
+			if !hasSender {
+				return nil, &EnvelopeError{lineNumber, ErrEnvelopeNoSender}
+			}
+
+			if len(envelope.Recipients) == 0 {
+				return nil, &EnvelopeError{lineNumber, ErrEnvelopeNoRecipients}
+			}
+
+			envelope.Data = content[offset:]
+			if strings.TrimSpace(envelope.Data) == "" {
+				return nil, &EnvelopeError{lineNumber, ErrEnvelopeEmptyData}
+			}
+
+			return envelope, nil
+		case strings.EqualFold(command, "MAIL FROM"):
+			if hasSender {
+				return nil, &EnvelopeError{lineNumber, ErrEnvelopeDuplicateSender}
+			}
+
+			address, err := parseEnvelopeAddress(argument)
+			if err != nil {
+				return nil, &EnvelopeError{lineNumber, err}
+			}
+
+			envelope.Sender = address
+			hasSender = true
+		case strings.EqualFold(command, "RCPT TO"):
+			if !hasSender {
+				return nil, &EnvelopeError{lineNumber, ErrEnvelopeOutOfOrder}
+			}
+
+			address, err := parseEnvelopeAddress(argument)
+			if err != nil {
+				return nil, &EnvelopeError{lineNumber, err}
+			}
+
+			envelope.Recipients = append(envelope.Recipients, address)
+		default:
+			return nil, &EnvelopeError{lineNumber, ErrEnvelopeUnknownCommand}
+		}
+	}
+
+	if !hasSender {
+		return nil, ErrEnvelopeNoSender
+	}
+
+	return nil, ErrEnvelopeNoData
+}
+
+// parseEnvelopeAddress parses the argument of a MAIL FROM or RCPT TO command, with or without angle brackets.
+func parseEnvelopeAddress(argument string) (EnvelopeAddress, error) {
+	argument = strings.TrimSpace(argument)
+	if strings.HasPrefix(argument, "<") && strings.HasSuffix(argument, ">") {
+		argument = argument[1 : len(argument)-1]
+	}
+
+	local, domain, found := strings.Cut(argument, "@")
+	if !found || local == "" || domain == "" || strings.ContainsAny(argument, " \t<>") || strings.Contains(domain, "@") {
+		return EnvelopeAddress{}, ErrEnvelopeInvalidAddress
+	}
+
+	return EnvelopeAddress{
+		Local:  local,
+		Domain: strings.ToLower(domain),
+	}, nil
+}
+
+// SentBy reports whether the envelope comes from mlid, with its w, at one of our domains.
+// The From header is checked as well, as a malicious user could send a correct envelope but spoof the mail itself.
+func (e *Envelope) SentBy(mlid string) bool {
+	if e.Sender.Local != mlid || !isLocalDomain(e.Sender.Domain) {
+		return false
+	}
+
+	from := e.HeaderFrom()
+	return from == "" || strings.Split(from, "@")[0] == mlid
+}
+
+// HeaderFrom returns the address in the From header of the message, or an empty string if there is none.
+func (e *Envelope) HeaderFrom() string {
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(e.Data)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return ""
+	}
+
+	from := strings.TrimSpace(header.Get("From"))
+	if start := strings.LastIndex(from, "<"); start != -1 && strings.HasSuffix(from, ">") {
+		from = from[start+1 : len(from)-1]
+	}
+
+	return from
+}
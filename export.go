@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/jackc/pgx/v5"
+)
+
+// QueryExportMail returns everything addressed to a Wii, whether or not it has been received yet,
+// along with mail it has sent that is still waiting to be received by other Wiis.
+const QueryExportMail = `SELECT m.snowflake, m.sender, m.recipient, COALESCE(m.data, b.data) FROM mail m
+	LEFT JOIN broadcasts b ON b.id = m.broadcast_id
+	WHERE m.recipient = $1 OR (m.sender = $1 AND m.is_sent = false) ORDER BY m.snowflake`
+
+// ExportedMail is a message as written to an export.
+type ExportedMail struct {
+	Snowflake int64
+	Sender    string
+	Recipient string
+	Data      string
+}
+
+// exportAddress turns a stored sender or recipient into an address, as Wiis are stored by their mlid without the w.
+func exportAddress(value string) string {
+	if !strings.Contains(value, "@") {
+		return fmt.Sprintf("w%s@%s", value, primaryDomain())
+	}
+
+	return value
+}
+
+// queryExportMail collects every message exported for an mlid, which is expected without the w.
+func queryExportMail(ctx context.Context, mlid string) ([]ExportedMail, error) {
+	rows, err := pool.Query(ctx, QueryExportMail, mlid)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (ExportedMail, error) {
+		var m ExportedMail
+		err := row.Scan(&m.Snowflake, &m.Sender, &m.Recipient, &m.Data)
+		return m, err
+	})
+}
+
+// writeMbox writes messages in the mboxrd format, which any mail client can import.
+// Lines starting with "From ", including ones already quoted with >, are quoted with another >.
+func writeMbox(w io.Writer, messages []ExportedMail) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range messages {
+		received := snowflake.ID(m.Snowflake).Time()
+		fmt.Fprintf(bw, "From %s %s\n", exportAddress(m.Sender), time.UnixMilli(received).UTC().Format(time.ANSIC))
+
+		data := strings.ReplaceAll(m.Data, "\r\n", "\n")
+		for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				bw.WriteString(">")
+			}
+
+			bw.WriteString(line)
+			bw.WriteString("\n")
+		}
+
+		bw.WriteString("\n")
+	}
+
+	return bw.Flush()
+}
+
+// exportAccount sends a Wii's mail back as an mbox archive, authenticated the same way as the other CGIs.
+func exportAccount(r *Response) {
+	mlid := r.PostForm("mlid")
+	password := r.PostForm("passwd")
+
+	ctx := r.Context()
+	err := validatePassword(ctx, mlid, password, r.ClientIP())
+	if errors.Is(err, ErrInvalidCredentials) {
+		cgi := GenCGIError(CGICodeInvalidCredentials, err.Error())
+		r.WriteCGI(cgi)
+		return
+	} else if cgi, banned := banResponse(err); banned {
+		r.WriteCGI(cgi)
+		return
+	} else if err != nil {
+		cgi := GenCGIError(CGICodeServerError, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
+		return
+	}
+
+	messages, err := queryExportMail(ctx, mlid[1:])
+	if err != nil {
+		cgi := GenCGIError(CGICodeServerError, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
+		return
+	}
+
+	r.Header("Content-Type", "application/mbox")
+	r.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.mbox"`, mlid))
+	r.Writer().WriteHeader(http.StatusOK)
+	err = writeMbox(r.Writer(), messages)
+	if err != nil {
+		r.ReportError(err)
+	}
+}
+
+// deleteAccountCGI permanently deletes a Wii's account and all of its mail.
+// The mlid has to be repeated in confirm so it cannot happen by accident.
+func deleteAccountCGI(r *Response) {
+	mlid := r.PostForm("mlid")
+	password := r.PostForm("passwd")
+
+	ctx := r.Context()
+	err := validatePassword(ctx, mlid, password, r.ClientIP())
+	if errors.Is(err, ErrInvalidCredentials) {
+		cgi := GenCGIError(CGICodeInvalidCredentials, err.Error())
+		r.WriteCGI(cgi)
+		return
+	} else if cgi, banned := banResponse(err); banned {
+		r.WriteCGI(cgi)
+		return
+	} else if err != nil {
+		cgi := GenCGIError(CGICodeServerError, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
+		return
+	}
+
+	if r.PostForm("confirm") != mlid {
+		cgi := GenCGIError(CGICodeInvalidParameter, "confirm must be the mlid of the account being deleted.")
+		r.WriteCGI(cgi)
+		return
+	}
+
+	err = deleteAccount(ctx, mlid[1:])
+	if err != nil {
+		cgi := GenCGIError(CGICodeDeleteFailed, "An error has occurred while deleting the account from the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
+		return
+	}
+
+	cgi := GenCGISuccess()
+
+	r.WriteCGI(cgi)
+}
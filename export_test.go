@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bwmarrin/snowflake"
+)
+
+func TestWriteMbox(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	// 2024-01-01 00:00:00 UTC
+	id := (int64(1704067200000) - snowflake.Epoch) << (snowflake.NodeBits + snowflake.StepBits)
+	messages := []ExportedMail{
+		{
+			Snowflake: id,
+			Sender:    "1234567890123456",
+			Data:      "Subject: Hi\r\n\r\nFrom the Wii\r\n>From before\r\n",
+		},
+		{
+			Snowflake: id,
+			Sender:    "user@example.com",
+			Data:      "Subject: Reply\n\nHello",
+		},
+	}
+
+	var buf bytes.Buffer
+	err := writeMbox(&buf, messages)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	expected := "From w1234567890123456@rc24.xyz Mon Jan  1 00:00:00 2024\n" +
+		"Subject: Hi\n\n>From the Wii\n>>From before\n\n" +
+		"From user@example.com Mon Jan  1 00:00:00 2024\n" +
+		"Subject: Reply\n\nHello\n\n"
+	if buf.String() != expected {
+		_t.Errorf("Incorrect mbox.\n\n Expected: '%s'\n\n Got: '%s'", expected, buf.String())
+	}
+}
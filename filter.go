@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/logrusorgru/aurora/v4"
+)
+
+const (
+	// Inbound mail is formulated for each recipient, so copies of one message differ and each is counted.
+	CountRecentMailFromSender = `SELECT COUNT(*) FROM mail WHERE sender = $1 AND snowflake > $2`
+	InsertQuarantine          = `INSERT INTO quarantine (snowflake, data, sender, recipient, reason) VALUES ($1, $2, $3, $4, $5)`
+
+	// DefaultSpamScoreThreshold is the content score at which mail is rejected if none is configured.
+	DefaultSpamScoreThreshold = 5
+)
+
+var (
+	authResultRegex = regexp.MustCompile(`(?i)\b(spf|dkim|dmarc)=([a-z]+)`)
+	urlRegex        = regexp.MustCompile(`(?i)https?://`)
+
+	defaultSpamKeywords = []string{
+		"bitcoin",
+		"casino",
+		"crypto wallet",
+		"gift card",
+		"lottery",
+		"viagra",
+		"wire transfer",
+		"you have won",
+	}
+)
+
+// InboundFilter inspects a message addressed to a Wii before it is queued.
+// It returns a reason if the message should be rejected, or an empty string to let it through.
+type InboundFilter struct {
+	Name  string
+	Check func(ctx context.Context, msg *Message, recipient string) (string, error)
+}
+
+// inboundFilters returns the filter chain in the order it is run.
+// Cheap checks go first so mail can be rejected before we query the database.
+func inboundFilters() []InboundFilter {
+	return []InboundFilter{
+		{Name: "blocklist", Check: blocklistFilter},
+		{Name: "authentication", Check: authenticationFilter},
+		{Name: "content", Check: contentFilter},
+		{Name: "volume", Check: volumeFilter},
+	}
+}
+
+// filterInbound runs the filter chain against a message.
+// The name of the filter that rejected the message is returned along with its reason.
+func filterInbound(ctx context.Context, msg *Message, recipient string) (string, string, error) {
+	if !config.SpamFilter.Enabled {
+		return "", "", nil
+	}
+
+	for _, filter := range inboundFilters() {
+		reason, err := filter.Check(ctx, msg, recipient)
+		if err != nil {
+			return "", "", err
+		}
+
+		if reason != "" {
+			return filter.Name, reason, nil
+		}
+	}
+
+	return "", "", nil
+}
+
+// rejectInbound logs why a message was rejected and quarantines it if configured to.
+// mlid is the recipient's, without the w.
+func rejectInbound(ctx context.Context, msg *Message, formulatedMail, mlid, filter, reason string) error {
+	log.Printf("%s %s -> w%s (%s): %s", aurora.BgBrightYellow("Rejected inbound mail"), msg.From.Address, mlid, filter, reason)
+
+	if config.UseDatadog {
+		err := dataDog.Incr("mail.inbound_rejected", []string{"filter:" + filter}, 1)
+		if err != nil {
+			ReportErrorGlobal(err)
+		}
+	}
+
+	if !config.SpamFilter.Quarantine {
+		return nil
+	}
+
+	_, err := pool.Exec(ctx, InsertQuarantine, flakeNode.Generate(), formulatedMail, msg.From.Address, mlid, fmt.Sprintf("%s: %s", filter, reason))
+	return err
+}
+
+// matchesSender reports whether address is in list. Entries are either full addresses,
+// or domains optionally prefixed with an @ to match every address at that domain.
+func matchesSender(list []string, address string) bool {
+	address = strings.ToLower(address)
+	domain := addressDomain(address)
+	for _, entry := range list {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == address || strings.TrimPrefix(entry, "@") == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+func blocklistFilter(_ context.Context, msg *Message, _ string) (string, error) {
+	if matchesSender(config.SpamFilter.BlockedSenders, msg.From.Address) {
+		return "sender is blocked", nil
+	}
+
+	return "", nil
+}
+
+// authenticationFilter reads the verdicts SES adds to received mail.
+func authenticationFilter(_ context.Context, msg *Message, _ string) (string, error) {
+	if strings.EqualFold(msg.Header.Get("X-SES-Virus-Verdict"), "FAIL") {
+		return "message contains a virus", nil
+	}
+
+	if !config.SpamFilter.RequireAuthentication {
+		return "", nil
+	}
+
+	results := parseAuthenticationResults(msg.Header.Get("Authentication-Results"))
+	if results["dmarc"] == "fail" {
+		return "DMARC check failed", nil
+	}
+
+	if results["spf"] != "pass" && results["dkim"] != "pass" {
+		return "neither SPF nor DKIM passed", nil
+	}
+
+	return "", nil
+}
+
+// parseAuthenticationResults returns the result of each method in an Authentication-Results header, i.e.
+// amazonses.com; spf=pass smtp.mailfrom=...; dkim=pass header.i=...; dmarc=pass header.from=...
+func parseAuthenticationResults(header string) map[string]string {
+	results := make(map[string]string)
+	for _, match := range authResultRegex.FindAllStringSubmatch(header, -1) {
+		results[strings.ToLower(match[1])] = strings.ToLower(match[2])
+	}
+
+	return results
+}
+
+func contentFilter(_ context.Context, msg *Message, _ string) (string, error) {
+	// The From address can be forged, so allowed senders only skip scoring, once the message has been authenticated.
+	if matchesSender(config.SpamFilter.AllowedSenders, msg.From.Address) {
+		return "", nil
+	}
+
+	threshold := config.SpamFilter.ScoreThreshold
+	if threshold == 0 {
+		threshold = DefaultSpamScoreThreshold
+	}
+
+	score, reasons := scoreContent(msg)
+	if score >= threshold {
+		return fmt.Sprintf("content score %d (%s)", score, strings.Join(reasons, ", ")), nil
+	}
+
+	return "", nil
+}
+
+// scoreContent gives a message points for every trait commonly found in spam.
+func scoreContent(msg *Message) (int, []string) {
+	score := 0
+	var reasons []string
+
+	if strings.EqualFold(msg.Header.Get("X-SES-Spam-Verdict"), "FAIL") {
+		score += 5
+		reasons = append(reasons, "SES spam verdict")
+	}
+
+	letters := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return -1
+	}, msg.Subject)
+	if len(letters) >= 8 && letters == strings.ToUpper(letters) {
+		score++
+		reasons = append(reasons, "shouting subject")
+	}
+
+	if urls := len(urlRegex.FindAllStringIndex(msg.Text, -1)); urls > 5 {
+		score += 2
+		reasons = append(reasons, fmt.Sprintf("%d links", urls))
+	}
+
+	keywords := config.SpamFilter.Keywords
+	if len(keywords) == 0 {
+		keywords = defaultSpamKeywords
+	}
+
+	content := strings.ToLower(msg.Subject + "\n" + msg.Text)
+	for _, keyword := range keywords {
+		if strings.Contains(content, strings.ToLower(keyword)) {
+			score += 2
+			reasons = append(reasons, fmt.Sprintf("keyword %q", keyword))
+		}
+	}
+
+	return score, reasons
+}
+
+// volumeFilter stops a single sender from flooding accounts.
+func volumeFilter(ctx context.Context, msg *Message, _ string) (string, error) {
+	limit := config.SpamFilter.MaxRecipientsPerSenderPerHour
+	if limit <= 0 {
+		return "", nil
+	}
+
+	var count int
+	err := pool.QueryRow(ctx, CountRecentMailFromSender, msg.From.Address, snowflakeAt(time.Now().Add(-time.Hour))).Scan(&count)
+	if err != nil {
+		return "", err
+	}
+
+	if count >= limit {
+		return fmt.Sprintf("sender has had %d copies of mail queued in the last hour", count), nil
+	}
+
+	return "", nil
+}
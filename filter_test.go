@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/mail"
+	"testing"
+)
+
+func TestMatchesSender(_t *testing.T) {
+	list := []string{"spammer@example.com", "@spam.example", "junk.example"}
+	cases := map[string]bool{
+		"spammer@example.com": true,
+		"SPAMMER@EXAMPLE.COM": true,
+		"friend@example.com":  false,
+		"anyone@spam.example": true,
+		"anyone@junk.example": true,
+		"anyone@notjunk.test": false,
+	}
+
+	for address, expected := range cases {
+		if got := matchesSender(list, address); got != expected {
+			_t.Errorf("matchesSender(%s) = %v, expected %v", address, got, expected)
+		}
+	}
+}
+
+func TestParseAuthenticationResults(_t *testing.T) {
+	results := parseAuthenticationResults("amazonses.com; spf=pass (spfCheck: domain of example.com designates 1.2.3.4 as permitted sender) smtp.mailfrom=a@example.com; dkim=fail header.i=@example.com; dmarc=PASS header.from=example.com;")
+	expected := map[string]string{"spf": "pass", "dkim": "fail", "dmarc": "pass"}
+	for method, result := range expected {
+		if results[method] != result {
+			_t.Errorf("Incorrect %s result.\n\n Expected: '%s'\n\n Got: '%s'", method, result, results[method])
+		}
+	}
+}
+
+func TestInboundFilters(_t *testing.T) {
+	config = &Config{SpamFilter: SpamFilterConfig{
+		Enabled:               true,
+		AllowedSenders:        []string{"@trusted.example"},
+		BlockedSenders:        []string{"blocked@example.com"},
+		RequireAuthentication: true,
+	}}
+	defer func() { config = nil }()
+
+	authenticated := mail.Header{"Authentication-Results": {"amazonses.com; spf=pass; dkim=pass; dmarc=pass"}}
+	cases := []struct {
+		name     string
+		msg      *Message
+		expected string
+	}{
+		{"clean", &Message{From: &mail.Address{Address: "friend@example.com"}, Subject: "Hello", Text: "How is your Wii?", Header: authenticated}, ""},
+		{"blocked", &Message{From: &mail.Address{Address: "blocked@example.com"}, Header: authenticated}, "blocklist"},
+		{"unauthenticated", &Message{From: &mail.Address{Address: "friend@example.com"}, Header: mail.Header{"Authentication-Results": {"amazonses.com; spf=fail; dkim=none; dmarc=none"}}}, "authentication"},
+		{"virus", &Message{From: &mail.Address{Address: "friend@example.com"}, Header: mail.Header{"X-Ses-Virus-Verdict": {"FAIL"}}}, "authentication"},
+		{"spam", &Message{From: &mail.Address{Address: "friend@example.com"}, Subject: "YOU HAVE WON THE LOTTERY", Text: "Claim your gift card", Header: authenticated}, "content"},
+		{"allowed", &Message{From: &mail.Address{Address: "bot@trusted.example"}, Subject: "YOU HAVE WON THE LOTTERY", Header: authenticated}, ""},
+		{"allowed forged", &Message{From: &mail.Address{Address: "bot@trusted.example"}, Subject: "YOU HAVE WON THE LOTTERY"}, "authentication"},
+		{"allowed virus", &Message{From: &mail.Address{Address: "bot@trusted.example"}, Header: mail.Header{"X-Ses-Virus-Verdict": {"FAIL"}, "Authentication-Results": authenticated["Authentication-Results"]}}, "authentication"},
+	}
+
+	for _, tc := range cases {
+		filter, reason, err := filterInbound(context.Background(), tc.msg, "w1234567890123456@rc24.xyz")
+		if err != nil {
+			_t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if filter != tc.expected {
+			_t.Errorf("%s: expected filter '%s', got '%s' (%s)", tc.name, tc.expected, filter, reason)
+		}
+	}
+}
@@ -16,7 +16,7 @@ import (
 	"time"
 	"unicode/utf8"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/WiiLink24/Mail-Server/secrets"
 	"github.com/k3a/html2text"
 	"golang.org/x/image/draw"
 
@@ -44,6 +44,7 @@ type Message struct {
 	From       *mail.Address
 	ToList     []*mail.Address
 	Subject    string
+	Header     mail.Header
 }
 
 func readMultipartMessage(message io.Reader, boundary string) (*Message, error) {
@@ -106,52 +107,62 @@ func processInbound() {
 
 		firstRun = false
 
-		// Get all mail in the bucket.
-		objects, err := GetObjects()
+		_, err := processInboundOnce()
 		if err != nil {
 			ReportErrorGlobal(err)
-			continue
 		}
+	}
+}
 
-		for _, object := range objects {
-			// Download the mail.
-			objectData, err := DownloadObject(object)
-			if err != nil {
-				ReportErrorGlobal(err)
-				continue
-			}
-
-			// Save to our server in a format the Wii can understand.
-			msg, err := readMessage(objectData)
-			if err != nil {
-				// Invalid message.
-				err = DeleteObject(object)
-				if err != nil {
-					ReportErrorGlobal(err)
-				}
-				continue
-			}
+// processInboundOnce saves every message currently in the bucket, returning how many objects were processed.
+// Errors with individual messages are reported and do not stop the rest from being processed.
+func processInboundOnce() (int, error) {
+	// Get all mail in the bucket.
+	objects, err := GetObjects()
+	if err != nil {
+		return 0, err
+	}
 
-			// Save to the server
-			err = saveMessage(msg)
-			if err != nil {
-				ReportErrorGlobal(err)
-				continue
-			}
+	for _, object := range objects {
+		// Download the mail.
+		objectData, err := DownloadObject(object)
+		if err != nil {
+			ReportErrorGlobal(err)
+			continue
+		}
 
-			// Finally delete.
+		// Save to our server in a format the Wii can understand.
+		msg, err := readMessage(objectData.Body)
+		objectData.Body.Close()
+		if err != nil {
+			// Invalid message.
 			err = DeleteObject(object)
 			if err != nil {
 				ReportErrorGlobal(err)
 			}
+			continue
+		}
+
+		// Save to the server
+		err = saveMessage(msg)
+		if err != nil {
+			ReportErrorGlobal(err)
+			continue
+		}
+
+		// Finally delete.
+		err = DeleteObject(object)
+		if err != nil {
+			ReportErrorGlobal(err)
 		}
 	}
+
+	return len(objects), nil
 }
 
-func readMessage(email *s3.GetObjectOutput) (*Message, error) {
+func readMessage(email io.Reader) (*Message, error) {
 	// Parse the mail message
-	defer email.Body.Close()
-	msg, err := mail.ReadMessage(email.Body)
+	msg, err := mail.ReadMessage(email)
 	if err != nil {
 		return nil, err
 	}
@@ -204,14 +215,15 @@ func readMessage(email *s3.GetObjectOutput) (*Message, error) {
 	parts.From = from
 	parts.ToList = toList
 	parts.Subject = subject
+	parts.Header = msg.Header
 
 	return parts, nil
 }
 
 func saveMessage(msg *Message) error {
 	for _, to := range msg.ToList {
-		// Discard anything that does not go to rc24.xyz.
-		if !strings.Contains(to.Address, "rc24.xyz") {
+		// Discard anything that does not go to one of our domains.
+		if !isLocalDomain(addressDomain(to.Address)) {
 			continue
 		}
 
@@ -220,19 +232,51 @@ func saveMessage(msg *Message) error {
 			return err
 		}
 
-		// We can do pretty much the exact same thing as the Wii send endpoint
 		parsedWiiNumber := strings.Split(to.Address, "@")[0]
-		_, err = pool.Exec(ctx, InsertMail, flakeNode.Generate(), formulatedMail, msg.From.Address, parsedWiiNumber[1:])
+		filter, reason, err := filterInbound(ctx, msg, to.Address)
+		if err != nil {
+			return err
+		}
+
+		if reason != "" {
+			err = rejectInbound(ctx, msg, formulatedMail, parsedWiiNumber[1:], filter, reason)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// We can do pretty much the exact same thing as the Wii send endpoint
+		policy, known, err := contactPolicyFor(ctx, parsedWiiNumber[1:], msg.From.Address)
+		if errors.Is(err, ErrRecipientNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !known && policy == ContactPolicyDrop {
+			continue
+		} else if !known && policy == ContactPolicyHold {
+			_, err = pool.Exec(ctx, InsertQuarantine, flakeNode.Generate(), formulatedMail, msg.From.Address, parsedWiiNumber[1:], ReasonUnknownContact)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		snowflake := flakeNode.Generate().Int64()
+		_, err = pool.Exec(ctx, InsertMail, snowflake, formulatedMail, msg.From.Address, parsedWiiNumber[1:], nil, nil)
 		if err != nil {
 			return err
 		}
+
+		checkCache.MailQueued(parsedWiiNumber[1:], snowflake)
 	}
 
 	return nil
 }
 
 func formulateMessage(from, to, subject string, msg *Message) (string, error) {
-	boundary := generateBoundary()
+	boundary := secrets.Boundary()
 
 	header := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n--%s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Description: wiimail\r\n\r\n",
 		from, to, subject, boundary, boundary)
@@ -244,9 +288,18 @@ func formulateMessage(from, to, subject string, msg *Message) (string, error) {
 		return content, nil
 	}
 
-	decodedImage, _, err := image.Decode(bytes.NewReader(msg.Attachment))
-	if err != nil {
-		return content, nil
+	// image.Decode only reads the first frame of a GIF and rejects animated WebPs entirely,
+	// so animations are flattened beforehand depending on the configured mode.
+	text := msg.Text
+	decodedImage, note, err := flattenAnimation(msg.Attachment, animatedImageMode())
+	if err == nil {
+		text = fmt.Sprint(text, "\r\n\r\n", note)
+		content = fmt.Sprint(header, text, strings.Repeat("\r\n", 3), "--", boundary, "--")
+	} else {
+		decodedImage, _, err = image.Decode(bytes.NewReader(msg.Attachment))
+		if err != nil {
+			return content, nil
+		}
 	}
 
 	// Resize if needed
@@ -280,7 +333,7 @@ func formulateMessage(from, to, subject string, msg *Message) (string, error) {
 	}
 
 	return fmt.Sprint(header,
-		msg.Text,
+		text,
 		strings.Repeat("\r\n", 3),
 		"--", boundary, "\r\n",
 		// Now we can put our image data.
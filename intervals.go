@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	UpdateCheckInterval = `UPDATE accounts SET check_interval = $2 WHERE mlid = $1`
+
+	// Intervals are in minutes, which is what the Wii expects.
+	DefaultCheckInterval       = 10
+	DefaultMinCheckInterval    = 1
+	DefaultMaxCheckInterval    = 24 * 60
+	DefaultActiveWindowMinutes = 30
+)
+
+// globalCheckInterval overrides IntervalConfig.Default at runtime when set through the admin API. 0 uses the config.
+var globalCheckInterval atomic.Int64
+
+// checkLoad counts check.cgi requests in the current second, to tell consoles to back off under heavy load.
+var checkLoad = &RequestRate{}
+
+// RequestRate counts requests per second.
+type RequestRate struct {
+	mu       sync.Mutex
+	second   int64
+	current  int64
+	previous int64
+}
+
+// Add counts a request and returns the rate, taken as the higher of this and the last full second.
+func (r *RequestRate) Add(now time.Time) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.roll(now)
+	r.current++
+	return max(r.current, r.previous)
+}
+
+// Rate returns the rate without counting a request.
+func (r *RequestRate) Rate(now time.Time) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.roll(now)
+	return max(r.current, r.previous)
+}
+
+func (r *RequestRate) roll(now time.Time) {
+	second := now.Unix()
+	if second != r.second {
+		if second == r.second+1 {
+			r.previous = r.current
+		} else {
+			r.previous = 0
+		}
+
+		r.second = second
+		r.current = 0
+	}
+}
+
+func intervalSetting(configured, fallback int) int {
+	if configured > 0 {
+		return configured
+	}
+
+	return fallback
+}
+
+func clampInterval(interval int) int {
+	minimum := intervalSetting(config.Intervals.Min, DefaultMinCheckInterval)
+	maximum := intervalSetting(config.Intervals.Max, DefaultMaxCheckInterval)
+	return min(max(interval, minimum), maximum)
+}
+
+// defaultCheckInterval is the interval for accounts without their own, either set at runtime or from config.
+func defaultCheckInterval() int {
+	if interval := globalCheckInterval.Load(); interval > 0 {
+		return clampInterval(int(interval))
+	}
+
+	return clampInterval(intervalSetting(config.Intervals.Default, DefaultCheckInterval))
+}
+
+// activeSince is the time after which sending mail makes an account active.
+func activeSince(now time.Time) time.Time {
+	return now.Add(-time.Duration(intervalSetting(config.Intervals.ActiveWindowMinutes, DefaultActiveWindowMinutes)) * time.Minute)
+}
+
+// checkInterval decides how many minutes a console should wait before checking for mail again.
+// An account's own interval takes priority over the default, then accounts that recently sent mail
+// poll at the active interval. Under load the interval is multiplied by how far over the limit we are.
+func checkInterval(accountInterval int, active bool, rate int64) int {
+	interval := defaultCheckInterval()
+	if accountInterval > 0 {
+		interval = accountInterval
+	} else if active && config.Intervals.Active > 0 {
+		interval = config.Intervals.Active
+	}
+
+	limit := int64(config.Intervals.BackoffRequestsPerSecond)
+	if limit > 0 && rate > limit {
+		interval *= int((rate + limit - 1) / limit)
+	}
+
+	return clampInterval(interval)
+}
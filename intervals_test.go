@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckInterval(_t *testing.T) {
+	config = &Config{Intervals: IntervalConfig{Active: 2, Max: 60, BackoffRequestsPerSecond: 100}}
+	defer func() {
+		config = nil
+		globalCheckInterval.Store(0)
+	}()
+
+	cases := []struct {
+		name            string
+		accountInterval int
+		active          bool
+		rate            int64
+		expected        int
+	}{
+		{"default", 0, false, 1, DefaultCheckInterval},
+		{"active", 0, true, 1, 2},
+		{"account", 30, true, 1, 30},
+		{"under load", 0, false, 250, 3 * DefaultCheckInterval},
+		{"capped", 30, false, 1000, 60},
+	}
+
+	for _, tc := range cases {
+		if got := checkInterval(tc.accountInterval, tc.active, tc.rate); got != tc.expected {
+			_t.Errorf("Incorrect interval for %s.\n\n Expected: '%d'\n\n Got: '%d'", tc.name, tc.expected, got)
+		}
+	}
+
+	globalCheckInterval.Store(15)
+	if got := checkInterval(0, false, 1); got != 15 {
+		_t.Errorf("Expected the runtime default of 15, got %d", got)
+	}
+}
+
+func TestRequestRate(_t *testing.T) {
+	rate := &RequestRate{}
+	start := time.Unix(1700000000, 0)
+	for i := 0; i < 5; i++ {
+		rate.Add(start)
+	}
+
+	if got := rate.Add(start.Add(time.Second)); got != 5 {
+		_t.Errorf("Expected the previous second's rate of 5, got %d", got)
+	}
+
+	if got := rate.Rate(start.Add(5 * time.Second)); got != 0 {
+		_t.Errorf("Expected the rate to reset after a quiet period, got %d", got)
+	}
+}
@@ -58,22 +58,8 @@ func main() {
 	defer sentry.Flush(2 * time.Second)
 
 	if config.UseDatadog {
-		// Initialize DataDog
-		tracer.Start(
-			tracer.WithService("mail"),
-			tracer.WithEnv("prod"),
-			tracer.WithAgentAddr("127.0.0.1:8126"),
-		)
-		defer tracer.Stop()
-
-		err = profiler.Start(
-			profiler.WithService("mail"),
-			profiler.WithEnv("prod"),
-		)
-		checkError(err)
-		defer profiler.Stop()
-
 		dataDog, err = statsd.New("127.0.0.1:8125")
+		checkError(err)
 	}
 
 	// Initialize snowflake
@@ -98,12 +84,37 @@ func main() {
 	// Ensure this Postgresql connection is valid.
 	defer pool.Close()
 
+	// Operator commands share the config, database and S3 setup, but do not start the server.
+	if len(os.Args) > 1 {
+		checkError(runCommand(os.Args[1:]))
+		return
+	}
+
+	if config.UseDatadog {
+		// Initialize DataDog
+		tracer.Start(
+			tracer.WithService("mail"),
+			tracer.WithEnv("prod"),
+			tracer.WithAgentAddr("127.0.0.1:8126"),
+		)
+		defer tracer.Stop()
+
+		err = profiler.Start(
+			profiler.WithService("mail"),
+			profiler.WithEnv("prod"),
+		)
+		checkError(err)
+		defer profiler.Stop()
+	}
+
 	fmt.Printf("Starting HTTP connection (%s)...\nNot using the usual port for HTTP?\nBe sure to use a proxy, otherwise the Wii can't connect!\n", config.Address)
 	if !config.IsDebug {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
 	g := gin.Default()
+	err = trustProxies(g)
+	checkError(err)
 
 	if config.UseOTLP {
 		tp, err := initTracer(config)
@@ -121,12 +132,13 @@ func main() {
 
 	g.Use(sentrygin.New(sentrygin.Options{}))
 
-	g.POST("/cgi-bin/check.cgi", check)
-	g.POST("/cgi-bin/send.cgi", send)
-	g.POST("/cgi-bin/receive.cgi", receive)
-	g.POST("/cgi-bin/delete.cgi", _delete)
-	g.POST("/cgi-bin/account.cgi", account)
+	route := newCGIRoute()
+	g.Any("/:service/:action", route.Handle())
+	registerCommunityAPI(g)
 
+	startAdminServer()
+	startMailEvents()
+	resumeBroadcasts()
 	go processInbound()
 	log.Fatalln(g.Run(config.Address))
 }
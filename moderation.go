@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/WiiLink24/nwc24"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	QueryActiveBan = `SELECT id, kind, value, reason, expires_at FROM bans
+		WHERE lifted_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+		AND ((kind = 'mlid' AND value = $1) OR (kind = 'hollywood' AND value = $2) OR (kind = 'ip' AND network >>= $3::inet))
+		ORDER BY expires_at DESC NULLS FIRST LIMIT 1`
+	InsertBan = `INSERT INTO bans (kind, value, network, reason, created_by, expires_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`
+	LiftBan   = `UPDATE bans SET lifted_at = now(), lifted_by = $2 WHERE id = $1 AND lifted_at IS NULL`
+	QueryBans = `SELECT id, kind, value, reason, created_by, created_at, expires_at, lifted_at FROM bans
+		WHERE $1 OR (lifted_at IS NULL AND (expires_at IS NULL OR expires_at > now())) ORDER BY id`
+	InsertBanAudit = `INSERT INTO ban_audit (ban_id, action, actor, reason) VALUES ($1, $2, $3, $4)`
+)
+
+// BanKind is what a ban is matched against.
+type BanKind string
+
+const (
+	BanKindMlid      BanKind = "mlid"
+	BanKindHollywood BanKind = "hollywood"
+	BanKindIP        BanKind = "ip"
+)
+
+var (
+	ErrBanNotFound    = errors.New("ban does not exist or has already been lifted")
+	ErrInvalidBanKind = errors.New("ban kind must be one of mlid, hollywood or ip")
+)
+
+// Ban is an active suspension.
+type Ban struct {
+	ID        int64
+	Kind      BanKind
+	Value     string
+	Reason    string
+	ExpiresAt *time.Time
+}
+
+// BanError is returned when a request comes from a suspended mlid, console or network.
+type BanError struct {
+	Ban Ban
+}
+
+func (e *BanError) Error() string {
+	if e.Ban.ExpiresAt == nil {
+		return fmt.Sprintf("This Wii has been suspended: %s", e.Ban.Reason)
+	}
+
+	return fmt.Sprintf("This Wii has been suspended until %s: %s", e.Ban.ExpiresAt.UTC().Format("2006-01-02 15:04 MST"), e.Ban.Reason)
+}
+
+// Code returns the CGI code for the kind of ban. Each kind has its own code so support can tell them apart.
+func (e *BanError) Code() CGICode {
+	switch e.Ban.Kind {
+	case BanKindHollywood:
+		return CGICodeSuspendedHollywood
+	case BanKindIP:
+		return CGICodeSuspendedIP
+	default:
+		return CGICodeSuspendedMlid
+	}
+}
+
+// banResponse returns the CGI response for a *BanError, or false if err is not one.
+func banResponse(err error) (CGIResponse, bool) {
+	var banErr *BanError
+	if errors.As(err, &banErr) {
+		return GenCGIError(banErr.Code(), banErr.Error()), true
+	}
+
+	return CGIResponse{}, false
+}
+
+// hollywoodIDFromMlid returns the hollywood ID encoded in a Wii number as 8 hex digits.
+// mlid is expected without the w, and to have been validated with validateFriendCode.
+func hollywoodIDFromMlid(mlid string) string {
+	id, err := strconv.ParseUint(mlid, 10, 64)
+	if err != nil {
+		return ""
+	}
+
+	wiiNumber := nwc24.LoadWiiNumber(id)
+	return fmt.Sprintf("%08x", wiiNumber.GetHollywoodID())
+}
+
+// checkBans returns a *BanError if the mlid, the console it belongs to or the IP is suspended.
+// mlid is expected without the w. Either argument may be empty to skip that check.
+func checkBans(ctx context.Context, mlid, ip string) error {
+	var mlidArg, hollywoodArg, ipArg *string
+	if mlid != "" {
+		hollywood := hollywoodIDFromMlid(mlid)
+		mlidArg, hollywoodArg = &mlid, &hollywood
+	}
+
+	if _, err := netip.ParseAddr(ip); err == nil {
+		ipArg = &ip
+	}
+
+	if mlidArg == nil && ipArg == nil {
+		return nil
+	}
+
+	var ban Ban
+	err := pool.QueryRow(ctx, QueryActiveBan, mlidArg, hollywoodArg, ipArg).Scan(&ban.ID, &ban.Kind, &ban.Value, &ban.Reason, &ban.ExpiresAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return &BanError{Ban: ban}
+}
+
+// normalizeBanValue validates a ban target and returns it in the form it is stored and matched in.
+// The second value is the network for IP bans.
+func normalizeBanValue(kind BanKind, value string) (string, *string, error) {
+	switch kind {
+	case BanKindMlid:
+		value = strings.TrimPrefix(strings.ToLower(value), "w")
+		if !validateFriendCode(value) {
+			return "", nil, errors.New("invalid Wii number")
+		}
+
+		return value, nil, nil
+	case BanKindHollywood:
+		value = strings.TrimPrefix(strings.ToLower(value), "0x")
+		id, err := strconv.ParseUint(value, 16, 32)
+		if err != nil {
+			return "", nil, errors.New("hollywood ID must be 8 hex digits")
+		}
+
+		return fmt.Sprintf("%08x", id), nil, nil
+	case BanKindIP:
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return "", nil, errors.New("invalid IP address")
+			}
+
+			if ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return "", nil, err
+		}
+
+		network := prefix.Masked().String()
+		return network, &network, nil
+	default:
+		return "", nil, ErrInvalidBanKind
+	}
+}
+
+// addBan suspends a target and records who did it.
+func addBan(ctx context.Context, kind BanKind, value, reason, actor string, duration time.Duration) (int64, error) {
+	value, network, err := normalizeBanValue(kind, value)
+	if err != nil {
+		return 0, err
+	}
+
+	var expiresAt *time.Time
+	if duration > 0 {
+		expiry := time.Now().Add(duration)
+		expiresAt = &expiry
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	var id int64
+	err = tx.QueryRow(ctx, InsertBan, kind, value, network, reason, actor, expiresAt).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(ctx, InsertBanAudit, id, "add", actor, reason)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	checkCache.ForgetBans()
+	return id, nil
+}
+
+// liftBan ends a suspension early and records who did it.
+func liftBan(ctx context.Context, id int64, reason, actor string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, LiftBan, id, actor)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrBanNotFound
+	}
+
+	_, err = tx.Exec(ctx, InsertBanAudit, id, "lift", actor, reason)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// runBanCommand handles the ban admin subcommand:
+//
+//	ban add [-duration 72h] [-reason text] [-actor name] <mlid|hollywood|ip> <value>
+//	ban lift [-reason text] [-actor name] <id>
+//	ban list [-all]
+func runBanCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: ban <add|lift|list> ...")
+	}
+
+	flags := flag.NewFlagSet("ban "+args[0], flag.ContinueOnError)
+	reason := flags.String("reason", "", "reason shown to the user and kept in the audit trail")
+	actor := flags.String("actor", os.Getenv("USER"), "operator responsible for the change")
+	duration := flags.Duration("duration", 0, "how long the ban lasts, forever if 0")
+	all := flags.Bool("all", false, "include lifted and expired bans")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "add":
+		if flags.NArg() != 2 {
+			return errors.New("usage: ban add [-duration 72h] [-reason text] [-actor name] <mlid|hollywood|ip> <value>")
+		}
+
+		id, err := addBan(ctx, BanKind(flags.Arg(0)), flags.Arg(1), *reason, *actor, *duration)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Added ban %d.\n", id)
+	case "lift":
+		if flags.NArg() != 1 {
+			return errors.New("usage: ban lift [-reason text] [-actor name] <id>")
+		}
+
+		id, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+		if err != nil {
+			return err
+		}
+
+		err = liftBan(ctx, id, *reason, *actor)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Lifted ban %d.\n", id)
+	case "list":
+		rows, err := pool.Query(ctx, QueryBans, *all)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tKIND\tVALUE\tREASON\tBY\tCREATED\tEXPIRES\tLIFTED")
+		for rows.Next() {
+			var id int64
+			var kind, value, banReason, createdBy string
+			var createdAt time.Time
+			var expiresAt, liftedAt *time.Time
+			err = rows.Scan(&id, &kind, &value, &banReason, &createdBy, &createdAt, &expiresAt, &liftedAt)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", id, kind, value, banReason, createdBy,
+				createdAt.Format(time.DateTime), formatOptionalTime(expiresAt), formatOptionalTime(liftedAt))
+		}
+
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown ban command %s", args[0])
+	}
+
+	return nil
+}
+
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+
+	return t.Format(time.DateTime)
+}
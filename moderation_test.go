@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeBanValue(_t *testing.T) {
+	cases := []struct {
+		kind     BanKind
+		value    string
+		expected string
+		network  bool
+	}{
+		{BanKindHollywood, "0x0403AC68", "0403ac68", false},
+		{BanKindHollywood, "1f", "0000001f", false},
+		{BanKindIP, "192.0.2.7", "192.0.2.7/32", true},
+		{BanKindIP, "192.0.2.7/24", "192.0.2.0/24", true},
+		{BanKindIP, "2001:db8::1", "2001:db8::1/128", true},
+	}
+
+	for _, tc := range cases {
+		value, network, err := normalizeBanValue(tc.kind, tc.value)
+		if err != nil {
+			_t.Fatalf("%s %s: %v", tc.kind, tc.value, err)
+		}
+
+		if value != tc.expected {
+			_t.Errorf("Incorrect value for %s %s.\n\n Expected: '%s'\n\n Got: '%s'", tc.kind, tc.value, tc.expected, value)
+		}
+
+		if (network != nil) != tc.network || (network != nil && *network != tc.expected) {
+			_t.Errorf("Incorrect network for %s %s: %v", tc.kind, tc.value, network)
+		}
+	}
+
+	for _, invalid := range []struct {
+		kind  BanKind
+		value string
+	}{
+		{BanKindMlid, "w1234"},
+		{BanKindHollywood, "not hex"},
+		{BanKindIP, "192.0.2.300"},
+		{"console", "1"},
+	} {
+		if _, _, err := normalizeBanValue(invalid.kind, invalid.value); err == nil {
+			_t.Errorf("Expected %s %s to be rejected", invalid.kind, invalid.value)
+		}
+	}
+}
+
+func TestBanError(_t *testing.T) {
+	err := error(&BanError{Ban: Ban{Kind: BanKindHollywood, Reason: "Spam"}})
+	cgi, banned := banResponse(err)
+	if !banned || cgi.code != CGICodeSuspendedHollywood {
+		_t.Errorf("Expected code %d, got %d", CGICodeSuspendedHollywood, cgi.code)
+	}
+
+	if _, banned = banResponse(errors.New("database error")); banned {
+		_t.Errorf("A non-ban error was treated as a ban")
+	}
+}
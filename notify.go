@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// MailEventsChannel receives every event. Each recipient also has its own channel, mail_<mlid>.
+	MailEventsChannel = "mail"
+
+	MailEventQueued    = "queued"
+	MailEventChanged   = "changed"
+	MailEventBroadcast = "broadcast"
+	// Account and bans events are only used to keep caches up to date, and are not passed on.
+	MailEventAccount = "account"
+	MailEventBans    = "bans"
+
+	WebhookSignatureHeader = "X-Mail-Signature"
+	webhookTimeout         = 10 * time.Second
+	webhookQueueSize       = 1000
+	listenerRetryDelay     = 5 * time.Second
+	eventSubscriberBuffer  = 100
+)
+
+// MailEvent is the payload of a notification sent by the mail table's trigger.
+// Queued events are sent for new mail, changed events when mail is received or deleted.
+// Broadcast events are sent by sendBroadcastBatch for each batch of a broadcast, which queues mail for some of
+// the accounts from FirstMlid to LastMlid.
+// Account events are sent when an account's credentials or interval change, and bans events when a ban does.
+type MailEvent struct {
+	Type      string `json:"type"`
+	Snowflake string `json:"snowflake"`
+	Recipient string `json:"recipient"`
+	Sender    string `json:"sender,omitempty"`
+	Mlid      string `json:"mlid,omitempty"`
+	Broadcast int64  `json:"broadcast,omitempty"`
+	FirstMlid string `json:"first_mlid,omitempty"`
+	LastMlid  string `json:"last_mlid,omitempty"`
+	Queued    int    `json:"queued,omitempty"`
+}
+
+const NotifyMailEvent = `SELECT pg_notify($1, $2)`
+
+// EventHub fans mail events out to subscribers, such as admin dashboards.
+// Slow subscribers miss events rather than holding up the others.
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan MailEvent]struct{}
+}
+
+var mailEvents = &EventHub{subscribers: map[chan MailEvent]struct{}{}}
+
+// webhookQueue holds events waiting to be posted to the configured webhooks.
+var webhookQueue = make(chan MailEvent, webhookQueueSize)
+
+func (h *EventHub) Subscribe() (chan MailEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := make(chan MailEvent, eventSubscriberBuffer)
+	h.subscribers[events] = struct{}{}
+	return events, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		delete(h.subscribers, events)
+	}
+}
+
+func (h *EventHub) Publish(event MailEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for subscriber := range h.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+		}
+	}
+}
+
+// handleMailEvent keeps the check cache in line with changes made by any server, then passes the event on.
+func handleMailEvent(event MailEvent) {
+	switch event.Type {
+	case MailEventQueued:
+		snowflake, err := strconv.ParseInt(event.Snowflake, 10, 64)
+		if err != nil {
+			ReportErrorGlobal(fmt.Errorf("invalid snowflake in mail event: %w", err))
+			return
+		}
+
+		checkCache.MailQueued(event.Recipient, snowflake)
+		if validateFriendCode(event.Sender) {
+			checkCache.MailSent(event.Sender)
+		}
+	case MailEventChanged:
+		checkCache.ForgetMailbox(event.Recipient)
+	case MailEventBroadcast:
+		checkCache.ForgetMailboxes(event.FirstMlid, event.LastMlid)
+	case MailEventAccount:
+		checkCache.ForgetAccount(event.Mlid)
+		return
+	case MailEventBans:
+		checkCache.ForgetBans()
+		return
+	default:
+		return
+	}
+
+	mailEvents.Publish(event)
+	if len(config.MailEvents.Webhooks) > 0 {
+		select {
+		case webhookQueue <- event:
+		default:
+			log.Printf("Webhook queue is full, dropping %s event for %s", event.Type, event.Snowflake)
+		}
+	}
+}
+
+// listenForMailEvents listens for notifications until ctx is done, reconnecting if the connection is lost.
+func listenForMailEvents(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := listenOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			ReportErrorGlobal(fmt.Errorf("mail event listener: %w", err))
+			time.Sleep(listenerRetryDelay)
+		}
+	}
+}
+
+func listenOnce(ctx context.Context) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The connection will still be listening, so it is taken from the pool rather than reused.
+	pgConn := conn.Hijack()
+	defer pgConn.Close(context.Background())
+
+	_, err = pgConn.Exec(ctx, "LISTEN "+MailEventsChannel)
+	if err != nil {
+		return err
+	}
+
+	for {
+		notification, err := pgConn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var event MailEvent
+		err = json.Unmarshal([]byte(notification.Payload), &event)
+		if err != nil {
+			ReportErrorGlobal(fmt.Errorf("invalid mail event payload: %w", err))
+			continue
+		}
+
+		handleMailEvent(event)
+	}
+}
+
+// signWebhook returns the HMAC-SHA256 of a webhook body with WebhookSecret, so receivers can verify it came from us.
+func signWebhook(body []byte) string {
+	h := hmac.New(sha256.New, []byte(config.MailEvents.WebhookSecret))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// deliverWebhooks posts queued events to every configured webhook. Failed deliveries are reported, not retried.
+func deliverWebhooks() {
+	client := &http.Client{Timeout: webhookTimeout}
+	for event := range webhookQueue {
+		body, err := json.Marshal(event)
+		if err != nil {
+			ReportErrorGlobal(err)
+			continue
+		}
+
+		for _, url := range config.MailEvents.Webhooks {
+			req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+			if err != nil {
+				ReportErrorGlobal(err)
+				continue
+			}
+
+			req.Header.Set("Content-Type", "application/json")
+			if config.MailEvents.WebhookSecret != "" {
+				req.Header.Set(WebhookSignatureHeader, signWebhook(body))
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				ReportErrorGlobal(fmt.Errorf("webhook %s: %w", url, err))
+				continue
+			}
+
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				ReportErrorGlobal(fmt.Errorf("webhook %s returned %s", url, resp.Status))
+			}
+		}
+	}
+}
+
+// startMailEvents starts listening for mail events if enabled.
+func startMailEvents() {
+	if !config.MailEvents.Enabled {
+		return
+	}
+
+	log.Println("Listening for mail events...")
+	go listenForMailEvents(ctx)
+	if len(config.MailEvents.Webhooks) > 0 {
+		go deliverWebhooks()
+	}
+}
+
+// adminEvents streams mail events to dashboards as server-sent events.
+func adminEvents(c *gin.Context) {
+	if !config.MailEvents.Enabled {
+		c.JSON(http.StatusNotFound, gin.H{"error": "mail events are not enabled"})
+		return
+	}
+
+	events, unsubscribe := mailEvents.Subscribe()
+	defer unsubscribe()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event := <-events:
+			c.SSEvent(event.Type, event)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/snowflake"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestHandleMailEvent(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	previous := checkCache
+	checkCache = NewCheckCache()
+	defer func() { checkCache = previous }()
+
+	past := time.Now().Add(-time.Second)
+	checkCache.Put("hash", CheckState{Mlid: "1234567890123456", OldestMail: 10, NewestMail: 10}, past)
+
+	events, unsubscribe := mailEvents.Subscribe()
+	defer unsubscribe()
+
+	handleMailEvent(MailEvent{Type: MailEventQueued, Snowflake: "20", Recipient: "1234567890123456", Sender: "user@example.com"})
+	if state, ok := checkCache.Get("hash"); !ok || state.NewestMail != 20 {
+		_t.Errorf("Expected the queued event to update the cache, got %v", state)
+	}
+
+	select {
+	case event := <-events:
+		if event.Snowflake != "20" {
+			_t.Errorf("Incorrect event.\n\n Expected: '20'\n\n Got: '%s'", event.Snowflake)
+		}
+	default:
+		_t.Errorf("Expected the event to be published")
+	}
+
+	handleMailEvent(MailEvent{Type: MailEventChanged, Snowflake: "20", Recipient: "1234567890123456"})
+	if _, ok := checkCache.Get("hash"); ok {
+		_t.Errorf("Expected the changed event to clear the mailbox")
+	}
+
+	checkCache.Put("hash", CheckState{Mlid: "1234567890123456"}, time.Now())
+	handleMailEvent(MailEvent{Type: MailEventBroadcast, Broadcast: 1, FirstMlid: "1000000000000000", LastMlid: "2000000000000000", Queued: 2})
+	if _, ok := checkCache.Get("hash"); ok {
+		_t.Errorf("Expected the broadcast event to clear the mailbox")
+	}
+
+	// The changed event was published too.
+	<-events
+	select {
+	case event := <-events:
+		if event.Broadcast != 1 {
+			_t.Errorf("Incorrect broadcast event %v", event)
+		}
+	default:
+		_t.Errorf("Expected the broadcast event to be published")
+	}
+}
+
+func TestHandleAccountEvents(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	previous := checkCache
+	checkCache = NewCheckCache()
+	defer func() { checkCache = previous }()
+
+	past := time.Now().Add(-time.Second)
+	checkCache.Put("hash", CheckState{Mlid: "1234567890123456"}, past)
+	checkCache.PutNotBanned("1234567890123456", "192.0.2.1")
+
+	events, unsubscribe := mailEvents.Subscribe()
+	defer unsubscribe()
+
+	// Credentials reset or bans added by another server must apply here straight away.
+	handleMailEvent(MailEvent{Type: MailEventAccount, Mlid: "1234567890123456"})
+	if _, ok := checkCache.Get("hash"); ok {
+		_t.Errorf("Expected the account event to clear the account")
+	}
+
+	handleMailEvent(MailEvent{Type: MailEventBans})
+	if checkCache.NotBanned("1234567890123456", "192.0.2.1") {
+		_t.Errorf("Expected the bans event to clear cached ban results")
+	}
+
+	select {
+	case event := <-events:
+		_t.Errorf("Expected the %s event not to be published", event.Type)
+	default:
+	}
+}
+
+func TestSignWebhook(_t *testing.T) {
+	config = &Config{MailEvents: MailEventConfig{WebhookSecret: "secret"}}
+	defer func() { config = nil }()
+
+	// echo -n '{}' | openssl dgst -sha256 -hmac secret
+	expected := "sha256=77325902caca812dc259733aacd046b73817372c777b8d95b402647474516e13"
+	if got := signWebhook([]byte("{}")); got != expected {
+		_t.Errorf("Incorrect signature.\n\n Expected: '%s'\n\n Got: '%s'", expected, got)
+	}
+}
+
+// testDatabase connects pool to the database in MAIL_SERVER_TEST_DATABASE and creates the tables in schema.sql,
+// skipping the test if it is not set. The database must be one that can be written to freely.
+func testDatabase(_t *testing.T) {
+	databaseURL := os.Getenv("MAIL_SERVER_TEST_DATABASE")
+	if databaseURL == "" {
+		_t.Skip("MAIL_SERVER_TEST_DATABASE is not set")
+	}
+
+	db, err := pgxpool.New(context.Background(), databaseURL)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	schema, err := os.ReadFile("schema.sql")
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	_, err = db.Exec(context.Background(), string(schema))
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	previousPool, previousNode := pool, flakeNode
+	pool = db
+	flakeNode, err = snowflake.NewNode(1)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	_t.Cleanup(func() {
+		db.Close()
+		pool, flakeNode = previousPool, previousNode
+	})
+}
+
+func TestListenOnce(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+	testDatabase(_t)
+
+	previous := checkCache
+	checkCache = NewCheckCache()
+	defer func() { checkCache = previous }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- listenOnce(ctx) }()
+
+	// Notifications sent before LISTEN runs are missed, so keep sending until one arrives.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		checkCache.PutNotBanned("1234567890123456", "192.0.2.1")
+		_, err := pool.Exec(context.Background(), "SELECT pg_notify($1, $2)", MailEventsChannel, `{"type":"bans"}`)
+		if err != nil {
+			_t.Fatal(err)
+		}
+
+		time.Sleep(50 * time.Millisecond)
+		if !checkCache.NotBanned("1234567890123456", "192.0.2.1") {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			_t.Fatal("No notification was handled")
+		}
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		_t.Errorf("The listener did not stop when cancelled")
+	}
+}
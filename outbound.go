@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+var (
+	ErrUnsupportedCharset = errors.New("unsupported charset")
+	unsafeFilenameRegex   = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+)
+
+// outboundAttachment is a part of a Wii message that will be attached as-is to the rebuilt message.
+type outboundAttachment struct {
+	contentType string
+	filename    string
+	data        []byte
+}
+
+// outboundParts is the result of walking a Wii message body.
+type outboundParts struct {
+	text        []string
+	attachments []outboundAttachment
+	// described contains a line for every Wii-specific part a PC cannot open.
+	described []string
+}
+
+// wiiPartDescriptions maps content types used by Wii titles to a human-readable description.
+var wiiPartDescriptions = map[string]string{
+	"application/x-wii-msgboard": "Wii Message Board data",
+	"application/x-wii-mii":      "a Mii",
+	"application/x-wii-speak":    "a Wii Speak voice message",
+	"audio/x-wii-speak":          "a Wii Speak voice message",
+	"application/octet-stream":   "Wii data",
+}
+
+// buildOutboundMessage rebuilds a message composed on a Wii into a standard MIME message for PC mail clients.
+// UTF-16 text is converted to UTF-8, images are attached with sane filenames,
+// and data only a Wii can read is described in the body instead.
+func buildOutboundMessage(raw string) ([]byte, error) {
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := &outboundParts{}
+	err = walkOutboundPart(parts, textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	writer := multipart.NewWriter(&out)
+
+	decoder := mime.WordDecoder{CharsetReader: charsetReader}
+	subject, err := decoder.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+
+	date := msg.Header.Get("Date")
+	if date == "" {
+		date = time.Now().Format(time.RFC1123Z)
+	}
+
+	fmt.Fprintf(&out, "From: %s\r\n", msg.Header.Get("From"))
+	fmt.Fprintf(&out, "To: %s\r\n", msg.Header.Get("To"))
+	fmt.Fprintf(&out, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&out, "Date: %s\r\n", date)
+	if messageID := msg.Header.Get("Message-Id"); messageID != "" {
+		fmt.Fprintf(&out, "Message-ID: %s\r\n", messageID)
+	}
+	fmt.Fprintf(&out, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&out, "Content-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n", writer.Boundary())
+
+	text := strings.Join(parts.text, "\r\n\r\n")
+	if len(parts.described) > 0 {
+		text = fmt.Sprint(text, "\r\n\r\n", strings.Join(parts.described, "\r\n"))
+	}
+
+	textHeader := textproto.MIMEHeader{}
+	textHeader.Set("Content-Type", "text/plain; charset=utf-8")
+	textHeader.Set("Content-Transfer-Encoding", "quoted-printable")
+	textPart, err := writer.CreatePart(textHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	qp := quotedprintable.NewWriter(textPart)
+	_, err = qp.Write([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+
+	err = qp.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range parts.attachments {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", mime.FormatMediaType(attachment.contentType, map[string]string{"name": attachment.filename}))
+		header.Set("Content-Transfer-Encoding", "base64")
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.filename}))
+		attachmentPart, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = attachmentPart.Write([]byte(wrapBase64(base64.StdEncoding.EncodeToString(attachment.data), 76)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// walkOutboundPart sorts a part, recursing into nested multiparts, into text, attachments or descriptions.
+func walkOutboundPart(parts *outboundParts, header textproto.MIMEHeader, body io.Reader) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "text/plain"
+	}
+
+	// A bad parameter still leaves us with a usable media type.
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil && !errors.Is(err, mime.ErrInvalidMediaParameter) {
+		return err
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := reader.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			err = walkOutboundPart(parts, p.Header, p)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := readTransferEncoded(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return err
+	}
+
+	filename := params["name"]
+	if _, dispositionParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && dispositionParams["filename"] != "" {
+		filename = dispositionParams["filename"]
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "text/plain"):
+		text, err := decodeCharset(params["charset"], data)
+		if err != nil {
+			return err
+		}
+
+		parts.text = append(parts.text, strings.TrimRight(text, "\x00"))
+	case strings.HasPrefix(mediaType, "image/"):
+		parts.attachments = append(parts.attachments, outboundAttachment{
+			contentType: mediaType,
+			filename:    sanitizeFilename(filename, mediaType, len(parts.attachments)+1),
+			data:        data,
+		})
+	default:
+		description, ok := wiiPartDescriptions[mediaType]
+		if !ok {
+			description = fmt.Sprintf("an attachment of type %s", mediaType)
+		}
+
+		parts.described = append(parts.described, fmt.Sprintf("[This message contained %s (%d bytes) that can only be viewed on a Wii.]", description, len(data)))
+	}
+
+	return nil
+}
+
+// readTransferEncoded reads a part body, undoing its Content-Transfer-Encoding.
+func readTransferEncoded(encoding string, body io.Reader) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+
+		// The Wii breaks base64 into lines, which the decoder does not accept.
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(body))
+	default:
+		return io.ReadAll(body)
+	}
+}
+
+// decodeCharset converts text in the charsets a Wii uses to UTF-8.
+func decodeCharset(charset string, data []byte) (string, error) {
+	switch strings.ToLower(charset) {
+	case "utf-16be":
+		return decodeUTF16(data, true), nil
+	case "utf-16le":
+		return decodeUTF16(data, false), nil
+	case "utf-16":
+		// Without a byte order mark UTF-16 is big endian.
+		if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+			return decodeUTF16(data[2:], false), nil
+		} else if len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff {
+			return decodeUTF16(data[2:], true), nil
+		}
+
+		return decodeUTF16(data, true), nil
+	case "iso-8859-1", "latin1":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+
+		return string(runes), nil
+	case "", "utf-8", "us-ascii":
+		return removeNonUTF8Characters(string(data)), nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedCharset, charset)
+	}
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+
+	return string(utf16.Decode(units))
+}
+
+// charsetReader lets mime.WordDecoder read the UTF-16 encoded words a Wii puts in its subjects.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := decodeCharset(charset, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.NewReader(text), nil
+}
+
+// sanitizeFilename keeps only the base name of an attachment made of characters every mail client accepts.
+// Parts without a usable name are numbered, i.e. photo1.jpg.
+func sanitizeFilename(filename, mediaType string, index int) string {
+	filename = strings.Trim(unsafeFilenameRegex.ReplaceAllString(path.Base(filename), "_"), "._")
+	if filename != "" && path.Ext(filename) != "" {
+		return filename
+	}
+
+	extension := ".bin"
+	if extensions, err := mime.ExtensionsByType(mediaType); err == nil && len(extensions) > 0 {
+		extension = extensions[0]
+	}
+
+	// mime returns .jfif first for image/jpeg on some systems.
+	if mediaType == "image/jpeg" {
+		extension = ".jpg"
+	}
+
+	return fmt.Sprintf("photo%d%s", index, extension)
+}
+
+// wrapBase64 breaks encoded data into lines of the given length.
+func wrapBase64(encoded string, lineLength int) string {
+	var builder strings.Builder
+	for len(encoded) > lineLength {
+		builder.WriteString(encoded[:lineLength])
+		builder.WriteString("\r\n")
+		encoded = encoded[lineLength:]
+	}
+
+	builder.WriteString(encoded)
+	return builder.String()
+}
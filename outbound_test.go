@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestOutboundRebuild(_t *testing.T) {
+	message := "Date: Sat, 02 May 2026 21:47:54 -0000\r\n" +
+		"From: w1234567890123456@rc24.xyz\r\n" +
+		"To: someone@example.com\r\n" +
+		"Message-Id: <00002000BBDE30A8.1234@rc24.xyz>\r\n" +
+		"Subject: =?UTF-16BE?B?AFAAaABvAHQAbw==?=\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed;\r\n boundary=\"BoundaryForDL202605022147/1234567\"\r\n" +
+		"X-Wii-AppId: 0-00000001-0001\r\n" +
+		"\r\n" +
+		"--BoundaryForDL202605022147/1234567\r\n" +
+		"Content-Type: text/plain; charset=utf-16be\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"AEgAZQBsAGwAbwAgAGYAcgBvAG0AIABtAHkAIABXAGkAaQAhACAA6Q==\r\n" +
+		"\r\n" +
+		"--BoundaryForDL202605022147/1234567\r\n" +
+		"Content-Type: image/jpeg; name=\"../../DCIM/HNI_0001.JPG\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"/9j/4AAQ\r\n" +
+		"\r\n" +
+		"--BoundaryForDL202605022147/1234567\r\n" +
+		"Content-Type: application/octet-stream; name=a0000102.dat\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"AAECAwQ=\r\n" +
+		"\r\n" +
+		"--BoundaryForDL202605022147/1234567--\r\n"
+
+	rebuilt, err := buildOutboundMessage(message)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(rebuilt))
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		_t.Fatal(err)
+	}
+	if subject != "Photo" {
+		_t.Errorf("Incorrect subject.\n\n Expected: '%s'\n\n Got: '%s'", "Photo", subject)
+	}
+
+	parts := &outboundParts{}
+	err = walkOutboundPart(parts, map[string][]string(msg.Header), msg.Body)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	expectedText := "Hello from my Wii! é\r\n\r\n[This message contained Wii data (5 bytes) that can only be viewed on a Wii.]"
+	if len(parts.text) != 1 || parts.text[0] != expectedText {
+		_t.Errorf("Incorrect body.\n\n Expected: '%s'\n\n Got: '%s'", expectedText, strings.Join(parts.text, ""))
+	}
+
+	if len(parts.attachments) != 1 {
+		_t.Fatalf("Incorrect attachment count.\n\n Expected: '%d'\n\n Got: '%d'", 1, len(parts.attachments))
+	}
+
+	if parts.attachments[0].filename != "HNI_0001.JPG" {
+		_t.Errorf("Incorrect filename.\n\n Expected: '%s'\n\n Got: '%s'", "HNI_0001.JPG", parts.attachments[0].filename)
+	}
+
+	if !bytes.Equal(parts.attachments[0].data, []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10}) {
+		_t.Errorf("Attachment data was altered: %x", parts.attachments[0].data)
+	}
+}
+
+func TestSanitizeFilename(_t *testing.T) {
+	cases := map[string]string{
+		"":                   "photo1.jpg",
+		"../../etc/passwd":   "photo1.jpg",
+		"my photo (1).jpeg":  "my_photo_1_.jpeg",
+		"HNI_0001.JPG":       "HNI_0001.JPG",
+		"\"quoted\"name.jpg": "quoted_name.jpg",
+	}
+
+	for input, expected := range cases {
+		if got := sanitizeFilename(input, "image/jpeg", 1); got != expected {
+			_t.Errorf("Incorrect filename for '%s'.\n\n Expected: '%s'\n\n Got: '%s'", input, expected, got)
+		}
+	}
+}
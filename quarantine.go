@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	QueryAccountQuarantine = `SELECT snowflake, sender, reason, LENGTH(data) FROM quarantine WHERE recipient = $1 ORDER BY snowflake`
+	DeleteQuarantine       = `DELETE FROM quarantine WHERE snowflake = $1 RETURNING data, sender, recipient`
+)
+
+type AdminQuarantinedMail struct {
+	Snowflake string `json:"snowflake"`
+	Sender    string `json:"sender"`
+	Reason    string `json:"reason"`
+	Size      int64  `json:"size"`
+}
+
+// adminListQuarantine lists the mail held for an account, by either a contact policy or the spam filter.
+func adminListQuarantine(c *gin.Context) {
+	mlid, ok := adminMlid(c)
+	if !ok {
+		return
+	}
+
+	rows, err := pool.Query(c, QueryAccountQuarantine, mlid)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	mail, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (AdminQuarantinedMail, error) {
+		var m AdminQuarantinedMail
+		var snowflake int64
+		err := row.Scan(&snowflake, &m.Sender, &m.Reason, &m.Size)
+		m.Snowflake = strconv.FormatInt(snowflake, 10)
+		return m, err
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"mail": mail})
+}
+
+// adminReleaseQuarantine delivers held mail to its recipient as if it had never been held.
+func adminReleaseQuarantine(c *gin.Context) {
+	snowflake, ok := adminSnowflake(c)
+	if !ok {
+		return
+	}
+
+	tx, err := pool.Begin(c)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	defer tx.Rollback(c)
+
+	var data, sender, recipient string
+	err = tx.QueryRow(c, DeleteQuarantine, snowflake).Scan(&data, &sender, &recipient)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "quarantined mail not found"})
+		return
+	} else if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	// The quarantine snowflake is from when the mail arrived, so it would be older than mail the Wii has already received.
+	// Mail sent by a title keeps its AppId and tag, as it would have had it not been held.
+	title, _ := parseTitleMetadata(data)
+	released := flakeNode.Generate().Int64()
+	_, err = tx.Exec(c, InsertMail, released, data, sender, recipient, optionalTitleField(title.AppID), optionalTitleField(title.Tag))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	err = tx.Commit(c)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	checkCache.MailQueued(recipient, released)
+
+	c.JSON(http.StatusOK, gin.H{"snowflake": strconv.FormatInt(released, 10)})
+}
@@ -4,52 +4,55 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/gin-gonic/gin"
+	"github.com/WiiLink24/Mail-Server/secrets"
 	"github.com/logrusorgru/aurora/v4"
 	"log"
-	"net/http"
 	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	QueryMailToSend = `SELECT snowflake, data FROM mail WHERE recipient = $1 AND is_sent = false ORDER BY snowflake LIMIT 10`
-	UpdateSentFlag  = `UPDATE mail SET is_sent = true WHERE snowflake = $1`
+	QueryMailToSend = `SELECT m.snowflake, COALESCE(m.data, b.data) FROM mail m LEFT JOIN broadcasts b ON b.id = m.broadcast_id
+		WHERE m.recipient = $1 AND m.is_sent = false ORDER BY m.snowflake LIMIT 10`
+	UpdateSentFlag = `UPDATE mail SET is_sent = true WHERE snowflake = $1`
 )
 
-func receive(c *gin.Context) {
-	mlid := c.PostForm("mlid")
-	password := c.PostForm("passwd")
+func receive(r *Response) {
+	mlid := r.PostForm("mlid")
+	password := r.PostForm("passwd")
 
 	// Queries can take extremely long and eat up memory. Prevent this by enforcing a timeout.
-	ctx, cancel := context.WithTimeout(c.Copy(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	err := validatePassword(ctx, mlid, password)
+	err := validatePassword(ctx, mlid, password, r.ClientIP())
 	if errors.Is(err, ErrInvalidCredentials) {
-		cgi := GenCGIError(250, err.Error())
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeInvalidCredentials, err.Error())
+		r.WriteCGI(cgi)
+		return
+	} else if cgi, banned := banResponse(err); banned {
+		r.WriteCGI(cgi)
 		return
 	} else if err != nil {
-		cgi := GenCGIError(551, "An error has occurred while querying the database.")
-		ReportErrorGin(c, err)
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeServerError, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
 		return
 	}
 
-	maxSize, err := strconv.Atoi(c.PostForm("maxsize"))
+	maxSize, err := strconv.Atoi(r.PostForm("maxsize"))
 	if err != nil {
-		cgi := GenCGIError(330, "maxsize needs to be an int.")
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeInvalidMaxSize, "maxsize needs to be an int.")
+		r.WriteCGI(cgi)
 		return
 	}
 
 	mail, err := pool.Query(ctx, QueryMailToSend, mlid[1:])
 	if err != nil {
-		cgi := GenCGIError(551, "An error has occurred while querying the database.")
-		ReportErrorGin(c, err)
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeServerError, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
 
 		// Determine if this was a timeout error and log if so.
 		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
@@ -62,8 +65,7 @@ func receive(c *gin.Context) {
 	mailToSend := new(strings.Builder)
 	numberOfMail := 0
 
-	boundary := generateBoundary()
-	c.Header("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%s", boundary))
+	boundary := secrets.Boundary()
 
 	defer mail.Close()
 	for mail.Next() {
@@ -72,7 +74,7 @@ func receive(c *gin.Context) {
 		err = mail.Scan(&snowflake, &data)
 		if err != nil {
 			// Abandon this mail and report to Sentry
-			ReportErrorGin(c, err)
+			r.ReportError(err)
 			continue
 		}
 
@@ -85,7 +87,7 @@ func receive(c *gin.Context) {
 				log.Printf("%s %d.", aurora.BgBrightYellow("Toggling update flag failed for message"), snowflake)
 			}
 
-			ReportErrorGin(c, err)
+			r.ReportError(err)
 			continue
 		}
 
@@ -104,33 +106,22 @@ func receive(c *gin.Context) {
 		mailSize += len(current)
 	}
 
-	cgi := CGIResponse{
-		code:    100,
-		message: "Success.",
-		other: []KV{
-			{
-				key:   "mailnum",
-				value: strconv.Itoa(numberOfMail),
-			},
-			{
-				key:   "mailsize",
-				value: strconv.Itoa(mailSize),
-			},
-			{
-				key:   "allnum",
-				value: strconv.Itoa(numberOfMail),
-			},
-		},
-	}
+	// Mail is now marked as sent, so check.cgi has to look at what is left in the queue.
+	checkCache.ForgetMailbox(mlid[1:])
+
+	cgi := GenCGISuccess()
+	cgi.Add("mailnum", strconv.Itoa(numberOfMail))
+	cgi.Add("mailsize", strconv.Itoa(mailSize))
+	cgi.Add("allnum", strconv.Itoa(numberOfMail))
 
 	if config.UseDatadog {
 		err = dataDog.Incr("mail.received_mail", nil, float64(numberOfMail))
 		if err != nil {
-			ReportErrorGin(c, err)
+			r.ReportError(err)
 		}
 	}
 
-	c.String(http.StatusOK, fmt.Sprint("--", boundary, "\r\n",
+	r.WriteMultipart(boundary, fmt.Sprint("--", boundary, "\r\n",
 		"Content-Type: text/plain\r\n\r\n",
 		"This part is ignored.\r\n\r\n\r\n\n",
 		ConvertToCGI(cgi),
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/WiiLink24/Mail-Server/secrets"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	InsertReprovisionToken = `INSERT INTO reprovision_tokens (token_hash, mlid, created_by, expires_at) VALUES ($1, $2, $3, $4)`
+	RedeemReprovisionToken = `UPDATE reprovision_tokens SET used_at = now()
+		WHERE token_hash = $1 AND mlid = $2 AND used_at IS NULL AND expires_at > now() RETURNING created_by`
+	QueryAccountExists = `SELECT EXISTS(SELECT 1 FROM accounts WHERE mlid = $1)`
+	QuerySerialHash    = `SELECT serial_hash FROM accounts WHERE mlid = $1`
+	UpdateSerialHash   = `UPDATE accounts SET serial_hash = $2 WHERE mlid = $1 AND serial_hash IS NULL`
+
+	// DefaultReprovisionTokenTTL is how long an operator-issued token can be used for.
+	DefaultReprovisionTokenTTL = 24 * time.Hour
+	ReprovisionTokenLength     = 32
+)
+
+var ErrReprovisionDenied = errors.New("unable to prove ownership of this Wii")
+
+// Form values a console or patcher can send to account.cgi to re-register an mlid that already exists.
+const (
+	ReprovisionTokenKey = "token"
+	HollywoodIDKey      = "hdid"
+	SerialNumberKey     = "sn"
+)
+
+// serialSecret normalises a console's serial number and binds it to the mlid, so a serial number recorded for one
+// account cannot be used for another.
+func serialSecret(mlid, serial string) string {
+	return fmt.Sprintf("%s:%s", mlid, strings.ToUpper(strings.TrimSpace(serial)))
+}
+
+// hashSerial hashes a console's serial number like a passwd. Serial numbers are short and partly predictable,
+// so they need the same salted, slow hash to not be brute forced from the database.
+func hashSerial(mlid, serial string) string {
+	return hashPasswd(serialSecret(mlid, serial))
+}
+
+// verifySerial checks a serial number against its stored hash in constant time.
+// Unlike passwd, serial numbers were never stored as unsalted SHA-512, so only argon2id hashes are accepted.
+func verifySerial(mlid, serial, stored string) bool {
+	if !strings.HasPrefix(stored, Argon2idPrefix) {
+		return false
+	}
+
+	ok, _, err := verifyPasswd(serialSecret(mlid, serial), stored)
+	return err == nil && ok
+}
+
+// issueReprovisionToken creates a one-time token that lets a console re-register an existing mlid.
+// mlid is expected without the w.
+func issueReprovisionToken(ctx context.Context, mlid, actor string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		ttl = DefaultReprovisionTokenTTL
+	}
+
+	var exists bool
+	err := pool.QueryRow(ctx, QueryAccountExists, mlid).Scan(&exists)
+	if err != nil {
+		return "", err
+	}
+
+	if !exists {
+		return "", ErrAccountNotFound
+	}
+
+	token := secrets.String(ReprovisionTokenLength)
+	_, err = pool.Exec(ctx, InsertReprovisionToken, hashPassword(token), mlid, actor, time.Now().Add(ttl))
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Re-registration token for w%s issued by %s", mlid, actor)
+	return token, nil
+}
+
+// verifyReprovision checks that a re-registration of an existing mlid comes from its owner.
+// Either an operator-issued token is redeemed, or the console proves itself with its hollywood ID
+// and the serial number it registered with.
+func verifyReprovision(ctx context.Context, mlid, token, hollywoodID, serial string) error {
+	if token != "" {
+		var issuedBy string
+		err := pool.QueryRow(ctx, RedeemReprovisionToken, hashPassword(token), mlid).Scan(&issuedBy)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrReprovisionDenied
+		} else if err != nil {
+			return err
+		}
+
+		log.Printf("w%s re-registered with a token issued by %s", mlid, issuedBy)
+		return nil
+	}
+
+	if hollywoodID == "" || serial == "" {
+		return ErrReprovisionDenied
+	}
+
+	// The hollywood ID is part of the Wii number, so this is only a consistency check and proves nothing.
+	// The serial number is what the console is verified with, and its hash is already bound to the mlid.
+	expectedHollywood := hollywoodIDFromMlid(mlid)
+	hollywood, _, err := normalizeBanValue(BanKindHollywood, hollywoodID)
+	if err != nil || hollywood != expectedHollywood {
+		return ErrReprovisionDenied
+	}
+
+	var serialHash *string
+	err = pool.QueryRow(ctx, QuerySerialHash, mlid).Scan(&serialHash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrAccountNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// Accounts registered before serial numbers were recorded can only be recovered with a token.
+	if serialHash == nil || !verifySerial(mlid, serial, *serialHash) {
+		return ErrReprovisionDenied
+	}
+
+	log.Printf("w%s re-registered with its serial number", mlid)
+	return nil
+}
+
+// rotateCredentials issues a new passwd and mlchkid for an existing account. Queued mail is kept.
+// If the console sent its serial number and the account has none recorded yet, it is recorded
+// so the console can prove itself without a token next time.
+func rotateCredentials(ctx context.Context, mlid, serial string) (Credentials, error) {
+	credentials := generateCredentials()
+	tag, err := pool.Exec(ctx, ResetCredentials, mlid, credentials.PasswordHash, credentials.MlchkidHash)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return Credentials{}, ErrAccountNotFound
+	}
+
+	checkCache.ForgetAccount(mlid)
+
+	if serial != "" {
+		_, err = pool.Exec(ctx, UpdateSerialHash, mlid, hashSerial(mlid, serial))
+		if err != nil {
+			return Credentials{}, err
+		}
+	}
+
+	return credentials, nil
+}
+
+// optionalSerialHash returns the hash to store for a serial number, or nil if the console did not send one.
+func optionalSerialHash(mlid, serial string) *string {
+	if serial == "" {
+		return nil
+	}
+
+	hash := hashSerial(mlid, serial)
+	return &hash
+}
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestHashSerial(_t *testing.T) {
+	hash := hashSerial("1234567890123456", "LEH123456789")
+	if !verifySerial("1234567890123456", " leh123456789 ", hash) {
+		_t.Errorf("Expected the serial number to match")
+	}
+
+	if hashSerial("1234567890123456", "LEH123456789") == hash {
+		_t.Errorf("The same serial number hashed identically twice")
+	}
+
+	if verifySerial("6543210987654321", "LEH123456789", hash) {
+		_t.Errorf("The serial number matched for another mlid")
+	}
+
+	if verifySerial("1234567890123456", "LEH123456789", "not a hash") {
+		_t.Errorf("Expected an invalid hash not to match")
+	}
+
+	if optionalSerialHash("1234567890123456", "") != nil {
+		_t.Errorf("Expected no hash without a serial number")
+	}
+}
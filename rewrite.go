@@ -0,0 +1,112 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// DomainRewrite maps a legacy domain found in mail sent by a Wii to the domain we currently serve.
+type DomainRewrite struct {
+	From string `xml:"from,attr"`
+	To   string `xml:"to,attr"`
+}
+
+var (
+	headerAddressRegex = regexp.MustCompile(`@([A-Za-z0-9.-]+)`)
+	// Format: w9004342343324713@wii.com <mailto:w9004342343324713@wii.com>
+	friendRequestRegex = regexp.MustCompile(`(w\d{16})@([A-Za-z0-9.-]+) <mailto:(w\d{16})@([A-Za-z0-9.-]+)>`)
+)
+
+// addressHeaders are the headers whose domains are rewritten.
+// Message identifiers are included as the Wii generates them with its own domain.
+var addressHeaders = map[string]bool{
+	"from":        true,
+	"to":          true,
+	"cc":          true,
+	"bcc":         true,
+	"reply-to":    true,
+	"sender":      true,
+	"return-path": true,
+	"message-id":  true,
+	"in-reply-to": true,
+	"references":  true,
+}
+
+// domainRewrites returns the configured rewrite table keyed by lowercase legacy domain.
+// Without one, wii.com and every alias domain are rewritten to the primary domain.
+func domainRewrites() map[string]string {
+	table := make(map[string]string)
+	if len(config.DomainRewrites) == 0 {
+		table[LegacyDomain] = primaryDomain()
+		for _, alias := range aliasDomains() {
+			table[strings.ToLower(alias)] = primaryDomain()
+		}
+
+		return table
+	}
+
+	for _, rewrite := range config.DomainRewrites {
+		table[strings.ToLower(rewrite.From)] = rewrite.To
+	}
+
+	return table
+}
+
+// rewriteDomain returns the replacement for domain, or domain itself if it is not in the table.
+func rewriteDomain(table map[string]string, domain string) string {
+	if replacement, ok := table[strings.ToLower(domain)]; ok {
+		return replacement
+	}
+
+	return domain
+}
+
+// rewriteDomains replaces legacy domains in the address-bearing headers of a message and in the
+// friend request line in its body. Everything else, including attachment data, is left untouched.
+func rewriteDomains(message string, table map[string]string) string {
+	headerEnd := strings.Index(message, "\r\n\r\n")
+	if headerEnd == -1 {
+		headerEnd = strings.Index(message, "\n\n")
+	}
+	if headerEnd == -1 {
+		headerEnd = len(message)
+	}
+
+	replaceAddress := func(match string) string {
+		return "@" + rewriteDomain(table, match[1:])
+	}
+
+	var builder strings.Builder
+	builder.Grow(len(message))
+
+	// Walk the header line by line, remembering the name of the current header for folded lines.
+	var currentHeader string
+	headers := message[:headerEnd]
+	for len(headers) > 0 {
+		end := strings.IndexByte(headers, '\n')
+		line := headers
+		if end != -1 {
+			line = headers[:end+1]
+		}
+		headers = headers[len(line):]
+
+		if line[0] != ' ' && line[0] != '\t' {
+			name, _, _ := strings.Cut(line, ":")
+			currentHeader = strings.ToLower(strings.TrimSpace(name))
+		}
+
+		if addressHeaders[currentHeader] {
+			line = headerAddressRegex.ReplaceAllStringFunc(line, replaceAddress)
+		}
+
+		builder.WriteString(line)
+	}
+
+	body := friendRequestRegex.ReplaceAllStringFunc(message[headerEnd:], func(match string) string {
+		parts := friendRequestRegex.FindStringSubmatch(match)
+		return parts[1] + "@" + rewriteDomain(table, parts[2]) + " <mailto:" + parts[3] + "@" + rewriteDomain(table, parts[4]) + ">"
+	})
+	builder.WriteString(body)
+
+	return builder.String()
+}
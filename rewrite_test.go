@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteDomains(_t *testing.T) {
+	table := map[string]string{
+		"wii.com":            "rc24.xyz",
+		"mail.wiilink24.com": "rc24.xyz",
+	}
+
+	envelope, err := ParseEnvelope(readEnvelopeFixture(_t, "friend_request.txt"))
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	rewritten := rewriteDomains(envelope.Data, table)
+	for _, expected := range []string{
+		"From: w1234567890123456@rc24.xyz\r\n",
+		"To: w6543210987654321@rc24.xyz\r\n",
+		"Message-Id: <00002000BBDE30A8.0003@rc24.xyz>\r\n",
+		"w1234567890123456@rc24.xyz <mailto:w1234567890123456@rc24.xyz>",
+	} {
+		if !strings.Contains(rewritten, expected) {
+			_t.Errorf("Expected rewritten message to contain '%s'.\n\n Got: '%s'", expected, rewritten)
+		}
+	}
+
+	if strings.Contains(rewritten, "@wii.com") {
+		_t.Errorf("Legacy domain was left in the message.\n\n Got: '%s'", rewritten)
+	}
+}
+
+func TestRewriteDomainsLeavesBodyAlone(_t *testing.T) {
+	table := map[string]string{"wii.com": "rc24.xyz"}
+	message := "From: w1234567890123456@wii.com\r\n" +
+		"To: someone@example.com,\r\n\tw6543210987654321@WII.COM\r\n" +
+		"Subject: visit nintendowii.com or mail me@wii.com\r\n" +
+		"\r\n" +
+		"See https://nintendowii.com and write to support@wii.com\r\n"
+
+	expected := "From: w1234567890123456@rc24.xyz\r\n" +
+		"To: someone@example.com,\r\n\tw6543210987654321@rc24.xyz\r\n" +
+		"Subject: visit nintendowii.com or mail me@wii.com\r\n" +
+		"\r\n" +
+		"See https://nintendowii.com and write to support@wii.com\r\n"
+
+	if rewritten := rewriteDomains(message, table); rewritten != expected {
+		_t.Errorf("Incorrect rewrite.\n\n Expected: '%s'\n\n Got: '%s'", expected, rewritten)
+	}
+}
@@ -1,26 +1,43 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"mime/multipart"
 	"net/http"
-	"strings"
+
+	"github.com/gin-gonic/gin"
 )
 
+const CGIContentType = "text/plain;charset=utf-8"
+
 type Route struct {
-	Actions []Action
+	Actions    []Action
+	Middleware []Middleware
 }
 
 // Action contains information about how a specified action should be handled.
 type Action struct {
 	ActionName  string
-	Callback    func(*Response) string
+	Callback    ActionFunc
 	ServiceType string
 }
 
+// ActionFunc handles a request to an action, writing its response through the given Response.
+type ActionFunc func(*Response)
+
+// Middleware wraps every action. It can act before and after calling next, or not call it to end the request.
+type Middleware func(action Action, next ActionFunc) ActionFunc
+
 func NewRoute() Route {
 	return Route{}
 }
 
+// Use adds middleware, which runs in the order it was added.
+func (r *Route) Use(middleware ...Middleware) {
+	r.Middleware = append(r.Middleware, middleware...)
+}
+
 // RoutingGroup defines a group of actions for a given service type.
 type RoutingGroup struct {
 	Route       *Route
@@ -35,7 +52,7 @@ func (r *Route) HandleGroup(serviceType string) RoutingGroup {
 	}
 }
 
-func (r *RoutingGroup) Handle(action string, function func(*Response) string) {
+func (r *RoutingGroup) Handle(action string, function ActionFunc) {
 	r.Route.Actions = append(r.Route.Actions, Action{
 		ActionName:  action,
 		Callback:    function,
@@ -43,59 +60,138 @@ func (r *RoutingGroup) Handle(action string, function func(*Response) string) {
 	})
 }
 
-func (r *Route) Handle() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		paths := strings.Split(req.URL.Path, "/")
-		if req.Method != "POST" {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
+// find returns the action registered for a service type and action name.
+func (r *Route) find(serviceType, actionName string) (Action, bool) {
+	for _, action := range r.Actions {
+		if action.ActionName == actionName && action.ServiceType == serviceType {
+			return action, true
 		}
+	}
 
-		if len(paths) < 3 {
-			// Invalid request. Should follow the format:
-			// ["", "cgi-bin", "account.cgi"]
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	return Action{}, false
+}
+
+// Handle returns a gin handler dispatching requests to registered actions. It should be registered as
+// /:service/:action, so that requests follow the format /cgi-bin/account.cgi.
+func (r *Route) Handle() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		resp := &Response{
+			request: c.Request,
+			writer:  c.Writer,
+			context: c,
 		}
 
-		// Ensure we can route to this action before processing.
-		// Search all registered actions and find a matching action.
-		var action Action
-		for _, routeAction := range r.Actions {
-			if routeAction.ActionName == paths[2] && routeAction.ServiceType == paths[1] {
-				action = routeAction
-			}
+		// Consoles only ever POST to CGIs.
+		if c.Request.Method != http.MethodPost {
+			c.Header("Allow", http.MethodPost)
+			resp.WriteStatusCGI(http.StatusMethodNotAllowed, GenCGIError(CGICodeInvalidMethod, "Invalid request method."))
+			return
 		}
 
-		// Action is only properly populated if we found it previously.
-		if action.ActionName == "" && action.ServiceType == "" {
-			w.WriteHeader(http.StatusBadRequest)
+		action, ok := r.find(c.Param("service"), c.Param("action"))
+		if !ok {
+			resp.WriteStatusCGI(http.StatusNotFound, GenCGIError(CGICodeUnknownAction, "Unknown action."))
 			return
 		}
 
-		resp := &Response{
-			request: req,
-			writer:  &w,
+		callback := action.Callback
+		for i := len(r.Middleware) - 1; i >= 0; i-- {
+			callback = r.Middleware[i](action, callback)
 		}
 
-		payload := action.Callback(resp)
-		w.Write([]byte(payload))
-	})
+		callback(resp)
+	}
 }
 
-func ConvertToCGI(response CGIResponse) string {
-	var work string
-	if response.code != 0 {
-		work += fmt.Sprintf("cd=%d\n", response.code)
-	}
+// newCGIRoute registers every CGI the console calls.
+func newCGIRoute() Route {
+	route := NewRoute()
+	route.Use(countRequests)
+
+	cgi := route.HandleGroup("cgi-bin")
+	cgi.Handle("check.cgi", check)
+	cgi.Handle("send.cgi", send)
+	cgi.Handle("receive.cgi", receive)
+	cgi.Handle("delete.cgi", _delete)
+	cgi.Handle("account.cgi", account)
+	cgi.Handle("contacts.cgi", contacts)
+	cgi.Handle("export.cgi", exportAccount)
+	cgi.Handle("deleteaccount.cgi", deleteAccountCGI)
+
+	return route
+}
 
-	if response.message != "" {
-		work += fmt.Sprintf("msg=%s\n", response.message)
-	}
+// countRequests is middleware counting requests to each action in Datadog.
+func countRequests(action Action, next ActionFunc) ActionFunc {
+	return func(r *Response) {
+		next(r)
 
-	for _, kv := range response.other {
-		work += fmt.Sprintf("%s=%s\n", kv.key, kv.value)
+		if config.UseDatadog {
+			err := dataDog.Incr("mail.cgi_requests", []string{"action:" + action.ActionName}, 1)
+			if err != nil {
+				r.ReportError(err)
+			}
+		}
 	}
+}
+
+// PostForm returns a value from the request's form, whether it was sent urlencoded or as multipart.
+func (r *Response) PostForm(key string) string {
+	return r.context.PostForm(key)
+}
+
+func (r *Response) MultipartForm() (*multipart.Form, error) {
+	return r.context.MultipartForm()
+}
+
+// ClientIP is the address the request came from. It is only taken from headers set by the proxies in TrustedProxies or
+// the TrustedPlatform header, as bans and login limits depend on it.
+func (r *Response) ClientIP() string {
+	return r.context.ClientIP()
+}
+
+// Context returns a context for database queries and other work outliving the handler's use of the request.
+func (r *Response) Context() context.Context {
+	return r.context.Copy()
+}
+
+func (r *Response) Header(key, value string) {
+	r.writer.Header().Set(key, value)
+}
+
+// Writer allows an action to write a body that is neither CGI key/values nor multipart.
+func (r *Response) Writer() http.ResponseWriter {
+	return r.writer
+}
+
+// ReportError reports an error to Sentry along with the request it occurred in.
+func (r *Response) ReportError(err error) {
+	ReportErrorGin(r.context, err)
+}
+
+// WriteCGI writes a CGI key/value response. Consoles expect it with a 200 status, even for errors.
+func (r *Response) WriteCGI(response CGIResponse) {
+	r.WriteStatusCGI(http.StatusOK, response)
+}
+
+func (r *Response) WriteStatusCGI(status int, response CGIResponse) {
+	r.cgi = response
+	r.response = ConvertToCGI(response)
+	r.Header("Content-Type", CGIContentType)
+	r.writer.WriteHeader(status)
+	r.writer.Write([]byte(r.response))
+}
+
+// WriteMultipart writes a multipart/mixed body, which must already be delimited by boundary.
+func (r *Response) WriteMultipart(boundary, body string) {
+	r.response = body
+	r.Header("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%s", boundary))
+	r.writer.WriteHeader(http.StatusOK)
+	r.writer.Write([]byte(body))
+}
 
-	return work
+// trustProxies configures which proxies the client IP is taken from. gin trusts X-Forwarded-For from anyone by default.
+func trustProxies(g *gin.Engine) error {
+	g.TrustedPlatform = config.TrustedPlatform
+	return g.SetTrustedProxies(config.TrustedProxies)
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRoute(_t *testing.T) {
+	var order []string
+	route := NewRoute()
+	route.Use(func(action Action, next ActionFunc) ActionFunc {
+		return func(r *Response) {
+			order = append(order, "first "+action.ActionName)
+			next(r)
+		}
+	}, func(action Action, next ActionFunc) ActionFunc {
+		return func(r *Response) {
+			order = append(order, "second")
+			next(r)
+		}
+	})
+
+	group := route.HandleGroup("cgi-bin")
+	group.Handle("echo.cgi", func(r *Response) {
+		r.WriteCGI(CGIResponse{code: 100, message: "Success.", other: []KV{{key: "mlid", value: r.PostForm("mlid")}}})
+	})
+
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	g.Any("/:service/:action", route.Handle())
+
+	cases := []struct {
+		method   string
+		path     string
+		status   int
+		expected string
+	}{
+		{http.MethodPost, "/cgi-bin/echo.cgi", http.StatusOK, "cd=100\nmsg=Success.\nmlid=w1234567890123456\n"},
+		{http.MethodGet, "/cgi-bin/echo.cgi", http.StatusMethodNotAllowed, "cd=300\nmsg=Invalid request method.\n"},
+		{http.MethodPost, "/cgi-bin/missing.cgi", http.StatusNotFound, "cd=301\nmsg=Unknown action.\n"},
+		{http.MethodPost, "/other/echo.cgi", http.StatusNotFound, "cd=301\nmsg=Unknown action.\n"},
+	}
+
+	for _, tc := range cases {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader("mlid=w1234567890123456"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, req)
+
+		if w.Code != tc.status || w.Body.String() != tc.expected {
+			_t.Errorf("Incorrect response to %s %s.\n\n Expected: %d '%s'\n\n Got: %d '%s'", tc.method, tc.path, tc.status, tc.expected, w.Code, w.Body.String())
+		}
+
+		if w.Header().Get("Content-Type") != CGIContentType {
+			_t.Errorf("Incorrect Content-Type '%s'", w.Header().Get("Content-Type"))
+		}
+	}
+
+	if strings.Join(order, ", ") != "first echo.cgi, second" {
+		_t.Errorf("Middleware ran as: %v", order)
+	}
+}
+
+func TestTrustProxies(_t *testing.T) {
+	defer func() { config = nil }()
+
+	cases := []struct {
+		config   Config
+		expected string
+	}{
+		{Config{}, "192.0.2.1"},
+		{Config{TrustedProxies: []string{"192.0.2.0/24"}}, "198.51.100.7"},
+		{Config{TrustedProxies: []string{"203.0.113.1"}}, "192.0.2.1"},
+		{Config{TrustedPlatform: "CF-Connecting-IP"}, "198.51.100.8"},
+	}
+
+	for _, tc := range cases {
+		config = &tc.config
+		gin.SetMode(gin.TestMode)
+		g := gin.New()
+		err := trustProxies(g)
+		if err != nil {
+			_t.Fatal(err)
+		}
+
+		var ip string
+		g.POST("/", func(c *gin.Context) {
+			ip = (&Response{context: c}).ClientIP()
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("X-Forwarded-For", "198.51.100.7")
+		req.Header.Set("CF-Connecting-IP", "198.51.100.8")
+		g.ServeHTTP(httptest.NewRecorder(), req)
+
+		if ip != tc.expected {
+			_t.Errorf("Incorrect client IP with %+v.\n\n Expected: '%s'\n\n Got: '%s'", tc.config, tc.expected, ip)
+		}
+	}
+}
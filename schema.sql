@@ -0,0 +1,200 @@
+-- Tables used by the mail server.
+
+CREATE TABLE IF NOT EXISTS accounts (
+    mlid     VARCHAR(16) PRIMARY KEY,
+    -- argon2id in the PHC string format, or unsalted SHA-512 until the Wii next authenticates.
+    password TEXT NOT NULL,
+    -- HMAC-SHA256 keyed with MlchkidKey, or unsalted SHA-512 until the Wii next checks for mail.
+    mlchkid  TEXT NOT NULL,
+    -- What happens to mail from senders not in contacts: off, hold or drop.
+    contact_policy TEXT NOT NULL DEFAULT 'off',
+    -- Hash of the console's serial number, used to prove ownership when re-registering.
+    serial_hash TEXT,
+    -- Minutes between checks for mail, overriding the configured interval when set.
+    check_interval INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS accounts_mlchkid ON accounts (mlchkid);
+
+CREATE TABLE IF NOT EXISTS mail (
+    snowflake BIGINT PRIMARY KEY,
+    data      TEXT NOT NULL,
+    sender    TEXT NOT NULL,
+    recipient VARCHAR(16) NOT NULL,
+    is_sent   BOOLEAN NOT NULL DEFAULT false
+);
+
+CREATE INDEX IF NOT EXISTS mail_recipient ON mail (recipient, is_sent);
+CREATE INDEX IF NOT EXISTS mail_sender ON mail (sender, snowflake);
+
+-- Inbound mail rejected by the spam filter, kept for review when quarantining is enabled,
+-- and mail held by a contact policy.
+CREATE TABLE IF NOT EXISTS quarantine (
+    snowflake BIGINT PRIMARY KEY,
+    data      TEXT NOT NULL,
+    sender    TEXT NOT NULL,
+    -- The mlid without the w, as in mail.
+    recipient TEXT NOT NULL,
+    reason    TEXT NOT NULL
+);
+
+-- Addresses a Wii has registered, either Wii numbers with their w or lowercase email addresses.
+CREATE TABLE IF NOT EXISTS contacts (
+    mlid    VARCHAR(16) NOT NULL REFERENCES accounts (mlid) ON DELETE CASCADE,
+    contact TEXT NOT NULL,
+    PRIMARY KEY (mlid, contact)
+);
+
+-- Suspended mlids, consoles (by hollywood ID, as 8 hex digits) and IP ranges.
+CREATE TABLE IF NOT EXISTS bans (
+    id         BIGSERIAL PRIMARY KEY,
+    kind       TEXT NOT NULL CHECK (kind IN ('mlid', 'hollywood', 'ip')),
+    value      TEXT NOT NULL,
+    network    CIDR,
+    reason     TEXT NOT NULL DEFAULT '',
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ,
+    lifted_at  TIMESTAMPTZ,
+    lifted_by  TEXT
+);
+
+CREATE INDEX IF NOT EXISTS bans_value ON bans (kind, value) WHERE lifted_at IS NULL;
+CREATE INDEX IF NOT EXISTS bans_network ON bans USING gist (network inet_ops) WHERE lifted_at IS NULL;
+
+-- Every change made to a ban.
+CREATE TABLE IF NOT EXISTS ban_audit (
+    id         BIGSERIAL PRIMARY KEY,
+    ban_id     BIGINT NOT NULL REFERENCES bans (id),
+    action     TEXT NOT NULL,
+    actor      TEXT NOT NULL,
+    reason     TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- One-time tokens issued by operators to let a console re-register an existing mlid.
+CREATE TABLE IF NOT EXISTS reprovision_tokens (
+    token_hash TEXT PRIMARY KEY,
+    mlid       VARCHAR(16) NOT NULL REFERENCES accounts (mlid) ON DELETE CASCADE,
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at    TIMESTAMPTZ
+);
+
+-- Communities creators send messages to, and the accounts subscribed to each one.
+CREATE TABLE IF NOT EXISTS communities (
+    id         BIGSERIAL PRIMARY KEY,
+    -- Used in the addresses consoles subscribe with, such as subscribe-news@rc24.xyz.
+    slug       TEXT NOT NULL UNIQUE,
+    name       TEXT NOT NULL,
+    -- SHA-512 of the token the creator sends messages with.
+    token_hash TEXT NOT NULL,
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS community_subscriptions (
+    community_id BIGINT NOT NULL REFERENCES communities (id) ON DELETE CASCADE,
+    mlid         VARCHAR(16) NOT NULL REFERENCES accounts (mlid) ON DELETE CASCADE,
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (community_id, mlid)
+);
+
+CREATE INDEX IF NOT EXISTS community_subscriptions_mlid ON community_subscriptions (mlid);
+
+-- Messages sent to many accounts at once. The body is stored here once, and each recipient's mail refers to it.
+CREATE TABLE IF NOT EXISTS broadcasts (
+    id           BIGSERIAL PRIMARY KEY,
+    data         TEXT NOT NULL,
+    sender       TEXT NOT NULL,
+    -- A description of who the broadcast is for, along with the mlids and activity it is limited to.
+    selector     TEXT NOT NULL,
+    mlids        TEXT[],
+    active_since BIGINT,
+    -- running, paused or done.
+    status       TEXT NOT NULL DEFAULT 'running',
+    -- The last account queued, as accounts are sent to in mlid order.
+    last_mlid    TEXT NOT NULL DEFAULT '',
+    sent         BIGINT NOT NULL DEFAULT 0,
+    total        BIGINT NOT NULL DEFAULT 0,
+    created_by   TEXT NOT NULL DEFAULT '',
+    created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at  TIMESTAMPTZ
+);
+
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS contact_policy TEXT NOT NULL DEFAULT 'off';
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS serial_hash TEXT;
+ALTER TABLE accounts ADD COLUMN IF NOT EXISTS check_interval INTEGER;
+
+-- Quarantined mail used to be stored under the recipient's address, or its mlid with the w.
+UPDATE quarantine SET recipient = substr(split_part(recipient, '@', 1), 2) WHERE recipient LIKE 'w%';
+
+-- The X-Wii-AppId and X-Wii-Tag headers of mail sent by a title, such as 1-48434a45-0001 for Wii Speak.
+ALTER TABLE mail ADD COLUMN IF NOT EXISTS app_id TEXT;
+ALTER TABLE mail ADD COLUMN IF NOT EXISTS wii_tag TEXT;
+CREATE INDEX IF NOT EXISTS mail_app_id ON mail (app_id, snowflake) WHERE app_id IS NOT NULL;
+
+-- Broadcasts sent by a community only go to its subscribers.
+ALTER TABLE broadcasts ADD COLUMN IF NOT EXISTS community_id BIGINT REFERENCES communities (id);
+
+-- Mail that is part of a broadcast has no data of its own.
+ALTER TABLE mail ADD COLUMN IF NOT EXISTS broadcast_id BIGINT REFERENCES broadcasts (id);
+ALTER TABLE mail ALTER COLUMN data DROP NOT NULL;
+DO $$
+BEGIN
+    ALTER TABLE mail ADD CONSTRAINT mail_has_data CHECK (data IS NOT NULL OR broadcast_id IS NOT NULL);
+EXCEPTION WHEN duplicate_object THEN
+    NULL;
+END;
+$$;
+
+-- Notifies the mail channel of every new, received or deleted message, and each recipient's own mail_<mlid>
+-- channel of new messages. Servers listen to keep their caches up to date and to send webhooks.
+-- Broadcasts queue thousands of messages at once, and send one event for each batch instead.
+CREATE OR REPLACE FUNCTION notify_mail() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        IF NEW.broadcast_id IS NOT NULL THEN
+            RETURN NULL;
+        END IF;
+
+        PERFORM pg_notify('mail', json_build_object('type', 'queued', 'snowflake', NEW.snowflake::text,
+            'recipient', NEW.recipient, 'sender', NEW.sender)::text);
+        PERFORM pg_notify('mail_' || NEW.recipient, NEW.snowflake::text);
+        RETURN NEW;
+    END IF;
+
+    PERFORM pg_notify('mail', json_build_object('type', 'changed', 'snowflake', OLD.snowflake::text,
+        'recipient', OLD.recipient)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS mail_notify ON mail;
+CREATE TRIGGER mail_notify AFTER INSERT OR DELETE OR UPDATE OF is_sent ON mail
+    FOR EACH ROW EXECUTE FUNCTION notify_mail();
+
+-- Notifies the mail channel when an account's credentials or interval change, or it is deleted, and when a ban is
+-- added or changed, so other servers stop answering check.cgi from their caches straight away.
+CREATE OR REPLACE FUNCTION notify_account() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('mail', json_build_object('type', 'account', 'mlid', OLD.mlid)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS account_notify ON accounts;
+CREATE TRIGGER account_notify AFTER DELETE OR UPDATE OF mlchkid, check_interval ON accounts
+    FOR EACH ROW EXECUTE FUNCTION notify_account();
+
+CREATE OR REPLACE FUNCTION notify_bans() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('mail', json_build_object('type', 'bans')::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS bans_notify ON bans;
+CREATE TRIGGER bans_notify AFTER INSERT OR UPDATE ON bans
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_bans();
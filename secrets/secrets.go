@@ -0,0 +1,60 @@
+// Package secrets generates random values for credentials, tokens and MIME boundaries from crypto/rand.
+package secrets
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Letters is the alphabet passwd and mlchkid are made from.
+const Letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+const (
+	boundaryTimeFormat = "200601021504"
+	boundaryMin        = 1000000
+	boundaryMax        = 9999999
+)
+
+// Bytes returns n random bytes.
+func Bytes(n int) []byte {
+	b := make([]byte, n)
+	// crypto/rand.Read never returns an error.
+	rand.Read(b)
+	return b
+}
+
+// String returns n random characters from Letters.
+func String(n int) string {
+	return StringFrom(n, Letters)
+}
+
+// StringFrom returns n random characters from alphabet, which must have between 1 and 256 characters.
+// Bytes that would bias the result towards the start of the alphabet are discarded.
+func StringFrom(n int, alphabet string) string {
+	if len(alphabet) == 0 || len(alphabet) > 256 {
+		panic("secrets: alphabet must have between 1 and 256 characters")
+	}
+
+	limit := 256 - 256%len(alphabet)
+	b := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(b) < n {
+		rand.Read(buf)
+		for _, c := range buf {
+			if int(c) < limit && len(b) < n {
+				b = append(b, alphabet[int(c)%len(alphabet)])
+			}
+		}
+	}
+
+	return string(b)
+}
+
+// Boundary returns a MIME boundary in the format the server has always sent, the current time followed by a 7 digit number.
+// Consoles parse receive.cgi responses with it, so the format is kept and only the number is now unpredictable.
+func Boundary() string {
+	n, _ := rand.Int(rand.Reader, big.NewInt(boundaryMax-boundaryMin))
+	return fmt.Sprintf("%s/%d", time.Now().Format(boundaryTimeFormat), n.Int64()+boundaryMin)
+}
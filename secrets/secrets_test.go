@@ -0,0 +1,62 @@
+package secrets
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestString(_t *testing.T) {
+	for _, n := range []int{0, 1, 16, 32, 33, 1000} {
+		s := String(n)
+		if len(s) != n {
+			_t.Errorf("Incorrect length.\n\n Expected: '%d'\n\n Got: '%d'", n, len(s))
+		}
+
+		for _, c := range s {
+			if !strings.ContainsRune(Letters, c) {
+				_t.Errorf("'%c' is not in the alphabet", c)
+			}
+		}
+	}
+}
+
+func TestStringDistribution(_t *testing.T) {
+	// An alphabet that does not divide 256 would be biased without discarding bytes.
+	alphabet := "abc"
+	samples := 300000
+	counts := map[rune]int{}
+	for _, c := range StringFrom(samples, alphabet) {
+		counts[c]++
+	}
+
+	// Chi-squared with 2 degrees of freedom. 13.8 is exceeded by chance 0.1% of the time.
+	expected := float64(samples) / float64(len(alphabet))
+	var chiSquared float64
+	for _, c := range alphabet {
+		diff := float64(counts[c]) - expected
+		chiSquared += diff * diff / expected
+	}
+
+	if chiSquared > 13.8 {
+		_t.Errorf("Characters are not uniformly distributed: %v (chi-squared %f)", counts, chiSquared)
+	}
+}
+
+func TestBoundary(_t *testing.T) {
+	format := regexp.MustCompile(`^\d{12}/[1-9]\d{6}$`)
+
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		boundary := Boundary()
+		seen[boundary] = true
+		if !format.MatchString(boundary) {
+			_t.Errorf("Boundary '%s' is not in the expected format", boundary)
+		}
+	}
+
+	// A few may collide, but the same number every time would mean it is not random.
+	if len(seen) < 90 {
+		_t.Errorf("Only %d of 100 boundaries were different", len(seen))
+	}
+}
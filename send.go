@@ -1,54 +1,48 @@
 package main
 
 import (
-	"bufio"
-	"database/sql"
 	"errors"
 	"fmt"
-	"net/http"
 	"net/smtp"
 	"regexp"
 	"strings"
-
-	"github.com/gin-gonic/gin"
+	"time"
 )
 
 var (
 	sendAuthRegex    = regexp.MustCompile(`^mlid=(w\d{16})\r?\npasswd=(.{16,32})$`)
-	mailFormKeyRegex = regexp.MustCompile(`m\d+`)
-	recipientRegex   = regexp.MustCompile(`^RCPT TO:\s(.*)@(.*)$`)
-	fromRegex        = regexp.MustCompile(`^MAIL FROM:\s(.*)@rc24.xyz$`)
-	fromRegexPayload = regexp.MustCompile(`^From:\s(.*)@rc24.xyz$`)
+	mailFormKeyRegex = regexp.MustCompile(`^m\d+$`)
 )
 
 const (
-	RecipientExists = `SELECT EXISTS(SELECT 1 FROM accounts WHERE mlid = $1)`
-	InsertMail      = `INSERT INTO mail (snowflake, data, sender, recipient, is_sent) VALUES ($1, $2, $3, $4, false)`
+	InsertMail = `INSERT INTO mail (snowflake, data, sender, recipient, is_sent, app_id, wii_tag) VALUES ($1, $2, $3, $4, false, $5, $6)`
 )
 
-func send(c *gin.Context) {
-	ctx := c.Copy()
-	c.Header("Content-Type", "text/plain;charset=utf-8")
+func send(r *Response) {
+	ctx := r.Context()
 
-	mlid, password := parseSendAuth(c.PostForm("mlid"))
-	err := validatePassword(ctx, mlid, password)
+	mlid, password := parseSendAuth(r.PostForm("mlid"))
+	err := validatePassword(ctx, mlid, password, r.ClientIP())
 	if errors.Is(err, ErrInvalidCredentials) {
-		cgi := GenCGIError(250, err.Error())
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeInvalidCredentials, err.Error())
+		r.WriteCGI(cgi)
+		return
+	} else if cgi, banned := banResponse(err); banned {
+		r.WriteCGI(cgi)
 		return
 	} else if err != nil {
-		cgi := GenCGIError(551, "An error has occurred while querying the database.")
-		ReportErrorGin(c, err)
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeServerError, "An error has occurred while querying the database.")
+		r.ReportError(err)
+		r.WriteCGI(cgi)
 		return
 	}
 
 	mails := make(map[string]string)
 
-	form, err := c.MultipartForm()
+	form, err := r.MultipartForm()
 	if err != nil {
-		cgi := GenCGIError(250, err.Error())
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeInvalidCredentials, err.Error())
+		r.WriteCGI(cgi)
 		return
 	}
 
@@ -59,120 +53,157 @@ func send(c *gin.Context) {
 	}
 
 	if len(mails) > 16 {
-		cgi := GenCGIError(351, "Too many messages were sent.")
-		c.String(http.StatusOK, ConvertToCGI(cgi))
+		cgi := GenCGIError(CGICodeTooManyMessages, "Too many messages were sent.")
+		r.WriteCGI(cgi)
 		return
 	}
 
-	cgi := new(CGIResponse)
-	cgi.code = 100
-	cgi.message = "Success."
+	cgi := GenCGISuccess()
 
 	for index, content := range mails {
 		var wiiRecipients []string
 		var emailRecipients []string
-		var hasError bool
-
-		// Read line by line.
-		// If you look in Git history, you can see that I used a method that was faster than this current one,
-		// then I learnt Wii Speak is able to send to multiple recipients at once.
-		msgIndex := 0
-		scanner := bufio.NewScanner(strings.NewReader(content))
-		for scanner.Scan() {
-			line := scanner.Text()
-
-			if line == "DATA" {
-				// We have reached the end of metadata parsing.
-				// Find the index of the actual data and skip to the end.
-				scanner.Scan()
-				line = scanner.Text()
-				msgIndex = strings.Index(content, line)
-				continue
-			}
+		var communityCommands []string
 
-			senderMatch := fromRegex.FindStringSubmatch(line)
-			if senderMatch != nil {
-				if senderMatch[1] != mlid {
-					cgi.AddMailResponse(index, 350, "Attempted to impersonate another user.")
-					hasError = true
-					break
-				}
-				continue
-			}
+		envelope, err := ParseEnvelope(content)
+		if err != nil {
+			cgi.AddMailResponse(index, CGICodeInvalidParameter, err.Error())
+			continue
+		}
 
-			recipientMatch := recipientRegex.FindStringSubmatch(line)
-			if recipientMatch != nil {
-				if recipientMatch[2] == "wii.com" {
-					// Theoretically this should not be possible.
-					// A message formulated by a Wii used the address found in nwc24msg.cfg.
-					// If we got far, it would be @rc24.xyz.
-					// Regardless, if this does happen we don't want it clogging up our database or wasting
-					// precious API calls.
-
-					// Going back to my second comment, there was a moment where an attacker had the recipient
-					// as WiiLink, causing it to spam both our clients. As such we should block any WiiLink recipients.
-				} else if recipientMatch[2] == "rc24.xyz" || recipientMatch[2] == "mail.wiilink24.com" {
-					wiiRecipients = append(wiiRecipients, recipientMatch[1])
-				} else {
-					// This is an email.
-					emailRecipients = append(emailRecipients, fmt.Sprintf("%s@%s", recipientMatch[1], recipientMatch[2]))
-				}
-			}
+		if !envelope.SentBy(mlid) {
+			cgi.AddMailResponse(index, CGICodeInvalidMail, "Attempted to impersonate another user.")
+			continue
+		}
 
-			// Additionally we also check the actual mail to see who it is coming from. A malicious user could
-			// send a correct header, but spoof the actual mail, impersonating another user
-			senderMatch = fromRegexPayload.FindStringSubmatch(line)
-			if senderMatch != nil {
-				if senderMatch[1] != mlid {
-					cgi.AddMailResponse(index, 350, "Attempted to impersonate another user.")
-					hasError = true
+		// Wii Speak is able to send to multiple recipients at once.
+		for _, recipient := range envelope.Recipients {
+			if isBlockedDomain(recipient.Domain) {
+				// Theoretically this should not be possible.
+				// A message formulated by a Wii used the address found in nwc24msg.cfg.
+				// If we got far, it would be our primary domain.
+				// Regardless, if this does happen we don't want it clogging up our database or wasting
+				// precious API calls.
+
+				// Going back to my second comment, there was a moment where an attacker had the recipient
+				// as WiiLink, causing it to spam both our clients. As such we should block any WiiLink recipients.
+			} else if isLocalDomain(recipient.Domain) {
+				if _, _, ok := parseCommunityCommand(recipient.Local); ok {
+					// Mail to subscribe-<slug>@ or unsubscribe-<slug>@ changes a subscription rather than being delivered.
+					communityCommands = append(communityCommands, recipient.Local)
+				} else {
+					wiiRecipients = append(wiiRecipients, recipient.Local)
 				}
-				break
+			} else {
+				// This is an email.
+				emailRecipients = append(emailRecipients, recipient.String())
 			}
 		}
 
-		if hasError {
-			continue
-		}
+		parsedMail := envelope.Data
 
-		parsedMail := content[msgIndex:]
+		// Replace @wii.com and other legacy domains in the headers and
+		// friend request line with our own domain.
+		parsedMail = rewriteDomains(parsedMail, domainRewrites())
 
-		// Replace all @wii.com references in the
-		// friend request email with our own domain.
-		// Format: w9004342343324713@wii.com <mailto:w9004342343324713@wii.com>
-		parsedMail = strings.ReplaceAll(parsedMail,
-			"wii.com",
-			"rc24.xyz")
+		parsedMail = strings.ReplaceAll(parsedMail, "\x00", "")
 
-		// We should also replace mail.wiilink24.com.
-		parsedMail = strings.ReplaceAll(parsedMail,
-			"mail.wiilink24.com",
-			"rc24.xyz")
+		// A title sending malformed headers is broken, but its mail can still be delivered.
+		// It is counted as invalid rather than sent, so each message has one result.
+		titleResult := "sent"
+		title, err := parseTitleMetadata(parsedMail)
+		if err != nil {
+			titleResult = "invalid"
+		}
 
-		parsedMail = strings.ReplaceAll(parsedMail, "\x00", "")
+		err = checkTitlePolicy(ctx, mlid[1:], title, len(parsedMail), len(wiiRecipients), len(emailRecipients))
+		if isTitlePolicyError(err) {
+			countTitleMail(r, title, "rejected")
+			cgi.AddMailResponse(index, CGICodeInvalidMail, err.Error())
+			continue
+		} else if err != nil {
+			cgi.AddMailResponse(index, CGICodeServerError, "An error has occurred while querying the database.")
+			r.ReportError(err)
+			continue
+		}
+
+		err = recordContacts(ctx, mlid[1:], append(wiiRecipients, emailRecipients...))
+		if err != nil {
+			// Failing to record contacts should not stop the mail from being sent.
+			r.ReportError(err)
+		}
 
 		var didError bool
-		for _, recipient := range wiiRecipients {
-			var exists bool
-			err := pool.QueryRow(ctx, RecipientExists, recipient[1:]).Scan(&exists)
-			if err != nil && !errors.Is(err, sql.ErrNoRows) {
-				cgi.AddMailResponse(index, 551, "Issue verifying recipient.")
-				ReportErrorGin(c, err)
+		for _, command := range communityCommands {
+			subscribe, slug, _ := parseCommunityCommand(command)
+			err = changeSubscription(ctx, subscribe, slug, mlid[1:])
+			if errors.Is(err, ErrCommunityNotFound) {
+				// Like mail to an account that doesn't exist, this is ignored.
+				continue
+			} else if err != nil {
+				cgi.AddMailResponse(index, CGICodeStorageFailed, "Database error.")
+				r.ReportError(err)
 				didError = true
 				break
-			} else if !exists {
+			}
+		}
+
+		// Friend registration has to reach Wiis that do not know the sender yet.
+		friendRegistration := isFriendRegistration(parsedMail, mlid)
+		for _, recipient := range wiiRecipients {
+			policy, known, err := contactPolicyFor(ctx, recipient[1:], mlid)
+			if errors.Is(err, ErrRecipientNotFound) {
 				// Account doesn't exist, ignore
 				continue
+			} else if err != nil {
+				cgi.AddMailResponse(index, CGICodeServerError, "Issue verifying recipient.")
+				r.ReportError(err)
+				didError = true
+				break
+			}
+
+			unknown := !known && !friendRegistration
+			if unknown && policy == ContactPolicyDrop {
+				continue
+			} else if unknown && policy == ContactPolicyHold {
+				_, err = pool.Exec(ctx, InsertQuarantine, flakeNode.Generate(), parsedMail, mlid[1:], recipient[1:], ReasonUnknownContact)
+				if err != nil {
+					cgi.AddMailResponse(index, CGICodeStorageFailed, "Database error.")
+					r.ReportError(err)
+					didError = true
+					break
+				}
+				continue
 			}
 
 			// Finally insert!
-			_, err = pool.Exec(ctx, InsertMail, flakeNode.Generate(), parsedMail, mlid[1:], recipient[1:])
+			snowflake := flakeNode.Generate().Int64()
+			data := parsedMail
+			if friendRegistration {
+				data = buildFriendRegistration(snowflake, mlid, recipient, time.Now())
+			}
+
+			_, err = pool.Exec(ctx, InsertMail, snowflake, data, mlid[1:], recipient[1:], optionalTitleField(title.AppID), optionalTitleField(title.Tag))
 			if err != nil {
-				cgi.AddMailResponse(index, 450, "Database error.")
-				ReportErrorGin(c, err)
+				cgi.AddMailResponse(index, CGICodeStorageFailed, "Database error.")
+				r.ReportError(err)
 				didError = true
 				break
 			}
+
+			checkCache.MailQueued(recipient[1:], snowflake)
+			checkCache.MailSent(mlid[1:])
+		}
+
+		// PC mail clients cannot read the Wii's UTF-16 multipart format, so rebuild it into a standard message.
+		// Should that fail we still send what the Wii gave us.
+		var pcMail []byte
+		if len(emailRecipients) > 0 {
+			pcMail, err = buildOutboundMessage(parsedMail)
+			if err != nil {
+				r.ReportError(err)
+				pcMail = []byte(parsedMail)
+			}
 		}
 
 		for _, recipient := range emailRecipients {
@@ -190,14 +221,14 @@ func send(c *gin.Context) {
 			err = smtp.SendMail(
 				fmt.Sprintf("%s:587", config.SMTPHost),
 				auth,
-				fmt.Sprintf("%s@rc24.xyz", mlid),
+				fmt.Sprintf("%s@%s", mlid, primaryDomain()),
 				[]string{recipient},
-				[]byte(parsedMail),
+				pcMail,
 			)
 
 			if err != nil {
-				cgi.AddMailResponse(index, 551, "SMTP error.")
-				ReportErrorGin(c, err)
+				cgi.AddMailResponse(index, CGICodeServerError, "SMTP error.")
+				r.ReportError(err)
 				didError = true
 				continue
 			}
@@ -205,16 +236,17 @@ func send(c *gin.Context) {
 
 		if !didError {
 			// If everything was successful we write that to the response.
-			cgi.AddMailResponse(index, 100, "Success.")
+			cgi.AddMailResponse(index, CGICodeSuccess, "Success.")
+			countTitleMail(r, title, titleResult)
 
 			if config.UseDatadog {
 				err = dataDog.Incr("mail.sent_mail", nil, 1)
 				if err != nil {
-					ReportErrorGin(c, err)
+					r.ReportError(err)
 				}
 			}
 		}
 	}
 
-	c.String(http.StatusOK, ConvertToCGI(*cgi))
+	r.WriteCGI(cgi)
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIsFriendRegistration(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	friendRequest := readEnvelopeFixture(_t, "friend_request.txt")
+	cases := []struct {
+		name     string
+		envelope string
+		expected bool
+	}{
+		{"friend request", friendRequest, true},
+		{"photo", readEnvelopeFixture(_t, "wii_to_wii.txt"), false},
+		{"wii speak", readEnvelopeFixture(_t, "wii_speak_multiple.txt"), false},
+		{"pc mail", readEnvelopeFixture(_t, "pc_mail.txt"), false},
+		{"other command", strings.Replace(friendRequest, "X-Wii-Cmd: 80010001", "X-Wii-Cmd: 80010002", 1), false},
+		{"other subject", strings.Replace(friendRequest, "Subject: WC24 Cmd Message", "Subject: Hello", 1), false},
+		{"extra header", strings.Replace(friendRequest, "MIME-Version", "X-Wii-Tag: 00000001\r\nMIME-Version", 1), false},
+		{"extra line", strings.TrimSuffix(friendRequest, "\r\n") + "\r\nVisit example.com\r\n", false},
+		{"other address", strings.Replace(friendRequest, "w1234567890123456@wii.com <mailto:w1234567890123456@wii.com>",
+			"w1111222233334444@wii.com <mailto:w1111222233334444@wii.com>", 1), false},
+	}
+
+	for _, tc := range cases {
+		envelope, err := ParseEnvelope(tc.envelope)
+		if err != nil {
+			_t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		data := rewriteDomains(envelope.Data, domainRewrites())
+		if got := isFriendRegistration(data, "w1234567890123456"); got != tc.expected {
+			_t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestBuildFriendRegistration(_t *testing.T) {
+	config = &Config{}
+	defer func() { config = nil }()
+
+	built := buildFriendRegistration(0x00002000BBDE30A8, "w1234567890123456", "w6543210987654321", time.Date(2026, 5, 2, 22, 0, 0, 0, time.UTC))
+	if !isFriendRegistration(built, "w1234567890123456") {
+		_t.Errorf("Expected the rebuilt message to be friend registration.\n\n Got: '%s'", built)
+	}
+
+	if !strings.Contains(built, "Date: Sat, 02 May 2026 22:00:00 -0000\r\n") || !strings.Contains(built, "Message-Id: <00002000BBDE30A8.0001@rc24.xyz>\r\n") {
+		_t.Errorf("Incorrect headers.\n\n Got: '%s'", built)
+	}
+}
+
+// TestSendToReceive sends the messages in testdata/envelopes through send.cgi and checks they arrive through receive.cgi.
+func TestSendToReceive(_t *testing.T) {
+	config = &Config{}
+	previousCache, previousLimiter := checkCache, authLimiter
+	defer func() {
+		config = nil
+		checkCache, authLimiter = previousCache, previousLimiter
+	}()
+	testDatabase(_t)
+	checkCache, authLimiter = NewCheckCache(), NewAuthLimiter()
+
+	sender, recipient := "1000000000000016", "1000000000000017"
+	passwd := createTestAccounts(_t, sender, recipient)
+	g := newTestCGIServer()
+
+	// Friend registration reaches Wiis that do not know the sender, even when they drop mail from strangers.
+	_, err := pool.Exec(context.Background(), UpdateContactPolicy, recipient, ContactPolicyDrop)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	for _, fixture := range []string{"friend_request.txt", "wii_speak_multiple.txt"} {
+		if got := sendFixture(_t, g, fixture, sender, recipient, passwd); !strings.Contains(got, "cd1=100\n") {
+			_t.Fatalf("%s: sending failed.\n\n Got: '%s'", fixture, got)
+		}
+	}
+
+	got := receiveMail(_t, g, recipient, passwd)
+	if !strings.Contains(got, "mailnum=1\n") || !strings.Contains(got, "X-Wii-Cmd: 80010001\r\n") {
+		_t.Errorf("Expected only the friend request to be delivered.\n\n Got: '%s'", got)
+	}
+
+	// The console reads the sender's address from the body, so it must be rewritten to our domain.
+	if !strings.Contains(got, "w"+sender+"@rc24.xyz <mailto:w"+sender+"@rc24.xyz>") {
+		_t.Errorf("Expected the friend request to be from our domain.\n\n Got: '%s'", got)
+	}
+
+	// Anything else from a stranger is held or dropped, even with an X-Wii-Cmd header.
+	forged := strings.Replace(fixtureBetween(_t, "friend_request.txt", sender, recipient), "Subject: WC24 Cmd Message", "Subject: Free points", 1)
+	for _, policy := range []ContactPolicy{ContactPolicyDrop, ContactPolicyHold} {
+		_, err = pool.Exec(context.Background(), UpdateContactPolicy, recipient, policy)
+		if err != nil {
+			_t.Fatal(err)
+		}
+
+		if got := sendEnvelope(g, sender, passwd, forged); !strings.Contains(got, "cd1=100\n") {
+			_t.Fatalf("%s: sending failed.\n\n Got: '%s'", policy, got)
+		}
+
+		if got := receiveMail(_t, g, recipient, passwd); !strings.Contains(got, "mailnum=0\n") {
+			_t.Errorf("%s: expected the message not to be delivered.\n\n Got: '%s'", policy, got)
+		}
+	}
+
+	var held int
+	err = pool.QueryRow(context.Background(), `SELECT COUNT(*) FROM quarantine WHERE sender = $1`, sender).Scan(&held)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	if held != 1 {
+		_t.Errorf("Expected one held message, got %d", held)
+	}
+
+	_, err = pool.Exec(context.Background(), UpdateContactPolicy, recipient, ContactPolicyOff)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	sendFixture(_t, g, "wii_speak_multiple.txt", sender, recipient, passwd)
+	got = receiveMail(_t, g, recipient, passwd)
+	if !strings.Contains(got, "mailnum=1\n") || !strings.Contains(got, "X-Wii-AppId: 1-48434a45-0001\r\n") ||
+		!strings.Contains(got, "name=a0000001.dat\r\n") {
+		_t.Errorf("Expected the Wii Speak message with its attachment.\n\n Got: '%s'", got)
+	}
+
+	var appID, tag string
+	err = pool.QueryRow(context.Background(), `SELECT app_id, wii_tag FROM mail WHERE recipient = $1 AND app_id IS NOT NULL`, recipient).Scan(&appID, &tag)
+	if err != nil {
+		_t.Fatal(err)
+	}
+
+	if appID != "1-48434a45-0001" || tag != "00000001" {
+		_t.Errorf("Incorrect title stored, got %s and %s", appID, tag)
+	}
+}
+
+func newTestCGIServer() *gin.Engine {
+	route := newCGIRoute()
+	gin.SetMode(gin.TestMode)
+	g := gin.New()
+	g.Any("/:service/:action", route.Handle())
+	return g
+}
+
+// sendFixture sends a message from testdata/envelopes through send.cgi, with its sender and first recipient
+// replaced by the given mlids.
+func sendFixture(_t *testing.T, g *gin.Engine, fixture, sender, recipient, passwd string) string {
+	return sendEnvelope(g, sender, passwd, fixtureBetween(_t, fixture, sender, recipient))
+}
+
+// fixtureBetween returns a message from testdata/envelopes, with its sender and first recipient replaced by the given mlids.
+func fixtureBetween(_t *testing.T, fixture, sender, recipient string) string {
+	return strings.NewReplacer("w1234567890123456", "w"+sender, "w6543210987654321", "w"+recipient).
+		Replace(readEnvelopeFixture(_t, fixture))
+}
+
+func sendEnvelope(g *gin.Engine, sender, passwd, envelope string) string {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	_ = writer.WriteField("mlid", fmt.Sprintf("mlid=w%s\r\npasswd=%s", sender, passwd))
+	_ = writer.WriteField("m1", envelope)
+	_ = writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/cgi-bin/send.cgi", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	return w.Body.String()
+}
+
+func receiveMail(_t *testing.T, g *gin.Engine, mlid, passwd string) string {
+	form := url.Values{"mlid": {"w" + mlid}, "passwd": {passwd}, "maxsize": {"100000"}}
+	req := httptest.NewRequest(http.MethodPost, "/cgi-bin/receive.cgi", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	return w.Body.String()
+}
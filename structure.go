@@ -3,18 +3,21 @@ package main
 import (
 	"encoding/xml"
 	"net/http"
+
+	"github.com/gin-gonic/gin"
 )
 
 // Response describes the inner response format, along with common fields across requests.
 type Response struct {
 	request  *http.Request
-	writer   *http.ResponseWriter
+	writer   http.ResponseWriter
+	context  *gin.Context
 	response string
 	cgi      CGIResponse
 }
 
 type CGIResponse struct {
-	code    int
+	code    CGICode
 	message string
 	other   []KV
 }
@@ -44,4 +47,119 @@ type Config struct {
 	AWSRegion    string   `xml:"AWSRegion"`
 	AWSBucket    string   `xml:"AWSBucket"`
 	IsDebug      bool     `xml:"IsDebug"`
+
+	// AnimatedImageMode is one of "first", "representative" or "contactsheet".
+	AnimatedImageMode string `xml:"AnimatedImageMode"`
+
+	// PrimaryDomain is the domain Wii accounts are addressed with, rc24.xyz by default.
+	PrimaryDomain string `xml:"PrimaryDomain"`
+	// AliasDomains are also accepted for Wii accounts and rewritten to PrimaryDomain.
+	AliasDomains []string `xml:"AliasDomains>Domain"`
+	// BlockedDomains are never delivered to, wii.com by default.
+	BlockedDomains []string `xml:"BlockedDomains>Domain"`
+
+	// DomainRewrites maps legacy domains in mail sent by a Wii to our own.
+	DomainRewrites []DomainRewrite `xml:"DomainRewrites>Rewrite"`
+
+	SpamFilter SpamFilterConfig `xml:"SpamFilter"`
+
+	// TrustedProxies are the addresses or CIDR ranges of proxies whose X-Forwarded-For header is believed.
+	// Without any, the address of the connection is used, as anyone can send the header.
+	TrustedProxies []string `xml:"TrustedProxies>Proxy"`
+	// TrustedPlatform is a header set by the platform in front of the server, such as CF-Connecting-IP.
+	// It is believed from every request, so it must only be set when the server cannot be reached directly.
+	TrustedPlatform string `xml:"TrustedPlatform"`
+
+	// AdminAddress is where the admin API listens. It must not be reachable by consoles.
+	AdminAddress string   `xml:"AdminAddress"`
+	AdminTokens  []string `xml:"AdminTokens>Token"`
+
+	AuthLimits AuthLimitConfig `xml:"AuthLimits"`
+
+	Intervals  IntervalConfig  `xml:"Intervals"`
+	MailEvents MailEventConfig `xml:"MailEvents"`
+
+	// CheckCacheSeconds is how long check.cgi caches accounts for, 300 by default. -1 disables the cache.
+	CheckCacheSeconds int `xml:"CheckCacheSeconds"`
+
+	Broadcasts BroadcastConfig `xml:"Broadcasts"`
+
+	// TitlePolicies limit what mail sent by particular titles can do.
+	TitlePolicies []TitlePolicy `xml:"TitlePolicies>Title"`
+
+	// MlchkidKey is the secret mlchkids are hashed with. Changing it stops every console from checking for mail.
+	MlchkidKey string `xml:"MlchkidKey"`
+}
+
+// AuthLimitConfig configures how repeated authentication failures are slowed down and locked out.
+// Unset values use the defaults in authlimit.go.
+type AuthLimitConfig struct {
+	// DelayAfter is how many consecutive failures are allowed before responses are delayed.
+	DelayAfter int `xml:"DelayAfter"`
+	// MlidLockoutFailures is how many consecutive failures for an mlid lock it out from the IP they came from,
+	// and IPLockoutFailures how many for any mlid lock the IP out entirely.
+	MlidLockoutFailures int `xml:"MlidLockoutFailures"`
+	IPLockoutFailures   int `xml:"IPLockoutFailures"`
+	LockoutMinutes      int `xml:"LockoutMinutes"`
+}
+
+// IntervalConfig configures how often consoles check for mail, in minutes.
+// Unset values use the defaults in intervals.go.
+type IntervalConfig struct {
+	Default int `xml:"Default"`
+	// Active is used for accounts that sent mail in the last ActiveWindowMinutes. 0 disables it.
+	Active              int `xml:"Active"`
+	ActiveWindowMinutes int `xml:"ActiveWindowMinutes"`
+	Min                 int `xml:"Min"`
+	Max                 int `xml:"Max"`
+	// BackoffRequestsPerSecond is the rate of check requests above which intervals are multiplied. 0 disables it.
+	BackoffRequestsPerSecond int `xml:"BackoffRequestsPerSecond"`
+}
+
+// TitlePolicy limits mail sent by one title, identified by the title ID in its X-Wii-AppId header.
+// Unset limits are not enforced.
+type TitlePolicy struct {
+	// TitleID is 8 hex digits, such as 48434a45 for Wii Speak.
+	TitleID string `xml:"TitleID"`
+	// MaxSize is the largest message in bytes.
+	MaxSize       int `xml:"MaxSize"`
+	MaxRecipients int `xml:"MaxRecipients"`
+	// WiiRecipientsOnly refuses mail to internet addresses.
+	WiiRecipientsOnly bool `xml:"WiiRecipientsOnly"`
+	// MaxPerSenderPerHour is how many messages from this title an account can send in an hour, however many Wiis each is to.
+	MaxPerSenderPerHour int `xml:"MaxPerSenderPerHour"`
+}
+
+// BroadcastConfig configures sending announcements to many accounts. Unset values use the defaults in broadcast.go.
+type BroadcastConfig struct {
+	// Sender is the address broadcasts come from, announcements@ the primary domain by default.
+	Sender string `xml:"Sender"`
+	// BatchSize is how many accounts are queued in each transaction.
+	BatchSize int `xml:"BatchSize"`
+}
+
+// MailEventConfig configures listening for notifications of new mail from Postgres.
+type MailEventConfig struct {
+	Enabled bool `xml:"Enabled"`
+	// Webhooks are posted every event as JSON, signed with WebhookSecret if set.
+	Webhooks      []string `xml:"Webhooks>URL"`
+	WebhookSecret string   `xml:"WebhookSecret"`
+}
+
+// SpamFilterConfig configures the checks run on inbound internet mail before it is queued.
+type SpamFilterConfig struct {
+	Enabled bool `xml:"Enabled"`
+	// AllowedSenders and BlockedSenders contain addresses, or domains to match every address at it.
+	// Mail from allowed senders is not scored, but must still pass the authentication and virus checks.
+	AllowedSenders []string `xml:"AllowedSenders>Sender"`
+	BlockedSenders []string `xml:"BlockedSenders>Sender"`
+	// MaxRecipientsPerSenderPerHour is how many Wiis a sender's mail can be queued for in an hour.
+	// Each Wii is given its own copy, so a message to several counts once for each. 0 disables the limit.
+	MaxRecipientsPerSenderPerHour int `xml:"MaxRecipientsPerSenderPerHour"`
+	// RequireAuthentication rejects mail that fails DMARC, or passes neither SPF nor DKIM.
+	RequireAuthentication bool     `xml:"RequireAuthentication"`
+	ScoreThreshold        int      `xml:"ScoreThreshold"`
+	Keywords              []string `xml:"Keywords>Keyword"`
+	// Quarantine stores rejected mail in the quarantine table instead of dropping it.
+	Quarantine bool `xml:"Quarantine"`
 }
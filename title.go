@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	// A message to several Wiis is stored once for each, with the same data, so it is only counted once.
+	CountRecentTitleMail = `SELECT COUNT(DISTINCT md5(data)) FROM mail WHERE sender = $1 AND split_part(app_id, '-', 2) = $2 AND snowflake > $3`
+	QueryTitleStats      = `SELECT COALESCE(m.app_id, ''), COUNT(*), COUNT(DISTINCT m.sender), COALESCE(SUM(LENGTH(COALESCE(m.data, b.data))), 0)
+		FROM mail m LEFT JOIN broadcasts b ON b.id = m.broadcast_id WHERE m.snowflake > $1 GROUP BY m.app_id ORDER BY COUNT(*) DESC`
+
+	DefaultTitleStatsDays = 7
+)
+
+var (
+	ErrInvalidAppID = errors.New("X-Wii-AppId is not in the form 1-48434a45-0001")
+	ErrInvalidTag   = errors.New("X-Wii-Tag is not 8 hex digits")
+
+	ErrTitleMailTooLarge      = errors.New("message is too large for this title")
+	ErrTitleTooManyRecipients = errors.New("message has too many recipients for this title")
+	ErrTitlePCMailNotAllowed  = errors.New("this title cannot send mail to internet addresses")
+	ErrTitleRateLimited       = errors.New("too many messages have been sent from this title recently")
+)
+
+// An AppId is the kind of title, its title ID and its group ID, such as 1-48434a45-0001 for Wii Speak.
+var appIDPattern = regexp.MustCompile(`^[0-9a-f]-[0-9a-f]{8}-[0-9a-f]{4}$`)
+
+// TitleMetadata identifies the title that sent a message, from the X-Wii-AppId and X-Wii-Tag headers it adds.
+// Both are empty for mail without them.
+type TitleMetadata struct {
+	AppID string
+	Tag   string
+}
+
+// TitleID returns the 8 hex digit title ID in the AppId, or "none" for mail without one.
+func (t TitleMetadata) TitleID() string {
+	if t.AppID == "" {
+		return "none"
+	}
+
+	return t.AppID[2:10]
+}
+
+// parseTitleMetadata reads the title headers of a message. Malformed headers are left empty and reported in the error,
+// so the message can still be delivered.
+func parseTitleMetadata(data string) (TitleMetadata, error) {
+	reader := textproto.NewReader(bufio.NewReader(strings.NewReader(data)))
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return TitleMetadata{}, nil
+	}
+
+	var title TitleMetadata
+	var errs []error
+	if appID := strings.ToLower(strings.TrimSpace(header.Get("X-Wii-AppId"))); appID != "" {
+		if appIDPattern.MatchString(appID) {
+			title.AppID = appID
+		} else {
+			errs = append(errs, ErrInvalidAppID)
+		}
+	}
+
+	if tag := strings.ToLower(strings.TrimSpace(header.Get("X-Wii-Tag"))); tag != "" {
+		if _, err := strconv.ParseUint(tag, 16, 32); err == nil && len(tag) == 8 {
+			title.Tag = tag
+		} else {
+			errs = append(errs, ErrInvalidTag)
+		}
+	}
+
+	return title, errors.Join(errs...)
+}
+
+// titlePolicy returns the policy configured for a title, if there is one.
+func titlePolicy(titleID string) (TitlePolicy, bool) {
+	for _, policy := range config.TitlePolicies {
+		if strings.EqualFold(policy.TitleID, titleID) {
+			return policy, true
+		}
+	}
+
+	return TitlePolicy{}, false
+}
+
+// check returns why a message is not allowed by the policy, if it isn't.
+func (p TitlePolicy) check(size, wiiRecipients, emailRecipients int) error {
+	if p.MaxSize > 0 && size > p.MaxSize {
+		return ErrTitleMailTooLarge
+	}
+
+	if p.MaxRecipients > 0 && wiiRecipients+emailRecipients > p.MaxRecipients {
+		return ErrTitleTooManyRecipients
+	}
+
+	if p.WiiRecipientsOnly && emailRecipients > 0 {
+		return ErrTitlePCMailNotAllowed
+	}
+
+	return nil
+}
+
+// checkTitlePolicy applies the policy for the title that sent a message. mlid is the sender, without the w.
+func checkTitlePolicy(ctx context.Context, mlid string, title TitleMetadata, size, wiiRecipients, emailRecipients int) error {
+	policy, ok := titlePolicy(title.TitleID())
+	if !ok {
+		return nil
+	}
+
+	err := policy.check(size, wiiRecipients, emailRecipients)
+	if err != nil || policy.MaxPerSenderPerHour <= 0 {
+		return err
+	}
+
+	var count int
+	err = pool.QueryRow(ctx, CountRecentTitleMail, mlid, title.TitleID(), snowflakeAt(time.Now().Add(-time.Hour))).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	if count >= policy.MaxPerSenderPerHour {
+		return ErrTitleRateLimited
+	}
+
+	return nil
+}
+
+// isTitlePolicyError reports whether err is a message being refused by a title policy, rather than a failure to check it.
+func isTitlePolicyError(err error) bool {
+	return errors.Is(err, ErrTitleMailTooLarge) || errors.Is(err, ErrTitleTooManyRecipients) ||
+		errors.Is(err, ErrTitlePCMailNotAllowed) || errors.Is(err, ErrTitleRateLimited)
+}
+
+// countTitleMail records in Datadog what happened to mail from a title: sent, rejected or invalid.
+func countTitleMail(r *Response, title TitleMetadata, result string) {
+	if !config.UseDatadog {
+		return
+	}
+
+	err := dataDog.Incr("mail.title_mail", []string{"title:" + title.TitleID(), "result:" + result}, 1)
+	if err != nil {
+		r.ReportError(err)
+	}
+}
+
+// optionalTitleField returns nil for empty title metadata, so it is stored as NULL.
+func optionalTitleField(value string) *string {
+	if value == "" {
+		return nil
+	}
+
+	return &value
+}
+
+// TitleStats is how much mail an AppId has sent.
+type TitleStats struct {
+	AppID   string `json:"app_id"`
+	Mail    int64  `json:"mail"`
+	Senders int64  `json:"senders"`
+	Size    int64  `json:"size"`
+}
+
+// adminTitleStats reports how much mail each title sent in the last ?days=, 7 by default.
+func adminTitleStats(c *gin.Context) {
+	days := DefaultTitleStatsDays
+	if value := c.Query("days"); value != "" {
+		var err error
+		days, err = strconv.Atoi(value)
+		if err != nil || days <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be a positive number"})
+			return
+		}
+	}
+
+	since := time.Now().AddDate(0, 0, -days)
+	rows, err := pool.Query(c, QueryTitleStats, snowflakeAt(since))
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	stats, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (TitleStats, error) {
+		var s TitleStats
+		err := row.Scan(&s.AppID, &s.Mail, &s.Senders, &s.Size)
+		return s, err
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"since": since.UTC().Format(time.RFC3339), "titles": stats})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseTitleMetadata(_t *testing.T) {
+	cases := []struct {
+		fixture  string
+		expected TitleMetadata
+	}{
+		{"wii_speak_multiple.txt", TitleMetadata{AppID: "1-48434a45-0001", Tag: "00000001"}},
+		{"friend_request.txt", TitleMetadata{AppID: "0-00000001-0001"}},
+		{"pc_mail.txt", TitleMetadata{}},
+	}
+
+	for _, tc := range cases {
+		envelope, err := ParseEnvelope(readEnvelopeFixture(_t, tc.fixture))
+		if err != nil {
+			_t.Fatalf("%s: %v", tc.fixture, err)
+		}
+
+		title, err := parseTitleMetadata(envelope.Data)
+		if err != nil || title != tc.expected {
+			_t.Errorf("%s: incorrect title.\n\n Expected: '%v'\n\n Got: '%v' (%v)", tc.fixture, tc.expected, title, err)
+		}
+	}
+
+	title, err := parseTitleMetadata("From: w1234567890123456@rc24.xyz\r\nX-Wii-AppId: 1-HCJE-0001\r\nX-Wii-Tag: 0000000G\r\n\r\nHello")
+	if !errors.Is(err, ErrInvalidAppID) || !errors.Is(err, ErrInvalidTag) || title != (TitleMetadata{}) {
+		_t.Errorf("Expected both headers to be rejected, got '%v' (%v)", title, err)
+	}
+
+	if title.TitleID() != "none" {
+		_t.Errorf("Incorrect title ID '%s'", title.TitleID())
+	}
+}
+
+func TestTitlePolicy(_t *testing.T) {
+	config = &Config{TitlePolicies: []TitlePolicy{{TitleID: "48434A45", MaxSize: 1000, MaxRecipients: 3, WiiRecipientsOnly: true}}}
+	defer func() { config = nil }()
+
+	speak := TitleMetadata{AppID: "1-48434a45-0001"}
+	cases := []struct {
+		title    TitleMetadata
+		size     int
+		wii      int
+		email    int
+		expected error
+	}{
+		{speak, 1000, 3, 0, nil},
+		{speak, 1001, 1, 0, ErrTitleMailTooLarge},
+		{speak, 100, 3, 1, ErrTitleTooManyRecipients},
+		{speak, 100, 1, 1, ErrTitlePCMailNotAllowed},
+		{TitleMetadata{AppID: "0-00000001-0001"}, 100000, 10, 10, nil},
+		{TitleMetadata{}, 100000, 10, 10, nil},
+	}
+
+	for _, tc := range cases {
+		err := checkTitlePolicy(context.Background(), "1234567890123456", tc.title, tc.size, tc.wii, tc.email)
+		if !errors.Is(err, tc.expected) {
+			_t.Errorf("Incorrect result for %v with size %d and %d+%d recipients.\n\n Expected: '%v'\n\n Got: '%v'", tc.title, tc.size, tc.wii, tc.email, tc.expected, err)
+		}
+
+		if (err != nil) != isTitlePolicyError(err) {
+			_t.Errorf("Expected %v to be a policy error", err)
+		}
+	}
+}
+
+// TestTitleRateLimit checks a message to several Wiis only counts once towards MaxPerSenderPerHour.
+func TestTitleRateLimit(_t *testing.T) {
+	config = &Config{TitlePolicies: []TitlePolicy{{TitleID: "48434a45", MaxPerSenderPerHour: 2}}}
+	previousCache, previousLimiter := checkCache, authLimiter
+	defer func() {
+		config = nil
+		checkCache, authLimiter = previousCache, previousLimiter
+	}()
+	testDatabase(_t)
+	checkCache, authLimiter = NewCheckCache(), NewAuthLimiter()
+
+	// The message is to both recipients, so each one sent is stored twice.
+	sender, recipient := "1000000000000016", "1000000000000017"
+	passwd := createTestAccounts(_t, sender, recipient, "1111222233334444")
+	g := newTestCGIServer()
+
+	envelope := fixtureBetween(_t, "wii_speak_multiple.txt", sender, recipient)
+	for i, expected := range []string{"cd1=100\n", "cd1=100\n", "cd1=350\n"} {
+		// Each message a Wii sends has its own Message-Id.
+		message := strings.Replace(envelope, "BBDE30A8.0002", fmt.Sprintf("BBDE30A8.%04d", i), 1)
+		if got := sendEnvelope(g, sender, passwd, message); !strings.Contains(got, expected) {
+			_t.Errorf("Message %d: expected '%s'.\n\n Got: '%s'", i+1, expected, got)
+		}
+	}
+}